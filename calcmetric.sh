@@ -29,6 +29,8 @@ export V3_LIMIT=200
 # export V3_LIMIT=20
 # export V3_OFFSET=0
 # export V3_SQL_PATH='./sql/'
+# export V3_SQL_PATH='https://metrics.example.com/sql/'
+# export V3_SQL_AUTH_HEADER='Authorization: Bearer token'
 # export V3_CALC_WEEK_DAILY=1
 # export V3_CALC_MONTH_DAILY=1
 # export V3_CALC_QUARTER_DAILY=1
@@ -43,5 +45,108 @@ export V3_LIMIT=200
 # export V3_DROP=1
 # export V3_DELETE='tr,ps,df,dt'
 # export V3_DELETE='ps,tr'
+# export V3_MAX_ROWS=100000
+# export V3_EXPECT_MIN_ROWS=1
+# export V3_EXPECT_MAX_ROWS=50000
+# export V3_EXPECT_KEEP=1
+# export V3_OUTPUT=matview
+# export V3_DELTA_KEY='memberid,platform,username'
+# export V3_DELTA_COLUMNS='contributions'
+# export V3_TIME_FORMAT=ms
+# export V3_ORDER_BY='contributions desc, memberid'
+# export V3_SUMMARY_METRIC=contr-lead-acts-total
+# export V3_COMPRESS_COLUMNS='payload'
+# export V3_KEEP_HISTORY=3
+# export V3_WEEK_START=sunday
+# export V3_TIME_RANGE=list
+# export V3_DATES='2023-01-01:2023-02-01,2023-02-01:2023-03-01'
+# export V3_TIME_RANGE=range
+# export V3_BACKFILL_FROM=2023-08-01
+# export V3_BACKFILL_TO=2023-11-01
+# export V3_BACKFILL_STEP=1d
+# export V3_THREADS=4
+# export V3_TYPED_SCAN=1
+# export V3_APPEND_ONLY=1
+# export V3_CONFLICT_ACTION=nothing
+# export V3_SESSION_SQL="set work_mem = '256MB'; set jit = off"
+# export V3_STATEMENT_TIMEOUT=30min
+# export V3_LOCK_TIMEOUT=10s
+# export V3_SEARCH_PATH=public
+# export V3_SEARCH_PATH_WRITES=1
+# export V3_DIFF=1
+# export V3_DIFF_MAX=100
+# export V3_TABLE_COMMENT='Active contributors per project'
+# export V3_COLUMN_COMMENT_contributions='Number of contributions'
+# export V3_PROJECT_SLUGS='korg,envoy'
+# export V3_PROJECTS_SQL='select distinct slug from projects'
+# export V3_PROGRESS_INTERVAL=30
+# export V3_COPY=1
+# export V3_COUNT_FIRST=1
+# export V3_COPY_THRESHOLD=100000
+# export V3_STORE_METRIC_NAME=1
+# export V3_SSL_MODE=verify-full
+# export V3_SSL_ROOT_CERT=./root.crt
+# export V3_PRINT_DDL=1
+# export V3_STATE_TABLE=metric_calculations
+# export V3_COUNT_TABLE=metric_row_counts
+# export V3_DAEMON=':8080'
+# export V3_DAEMON_TOKEN=secret
+# export V3_LISTEN=recalc
+# export V3_IMMUTABLE_COLUMNS=first_seen_at
+# export V3_VERSIONED_SQL=1
+# export V3_CHECK_ONLY=1
+# export V3_PARTITION_BY=time_range
+# export V3_RETENTION='2 years'
+# export V3_METRIC_SUBTRACT=contr-lead-activities-excluded
+# export V3_SUBTRACT_KEY=name
+# export V3_SUBTRACT_COLUMNS=contributions
+# export V3_ASSERT_SQL_HASH="`sha256sum sql/contr-lead-activities.sql | cut -f 1 -d ' '`"
+# export V3_TOUCH=1
+# export V3_START_JITTER=0-120s
+# export V3_OUTPUT=kafka,db
+# export V3_KAFKA_BROKERS='localhost:9092'
+# export V3_KAFKA_TOPIC=calcmetric
+# export V3_NOW='2023-06-15'
+# export V3_PREV_MODE=yoy
+# export V3_YTD_PREV=yoy
+# export V3_COLUMN_TYPE_cnt=bigint
+# export V3_RECORD_EMPTY=1
+# export V3_CONTINUE_ON_ERROR=1
+# export V3_PARAM_FILE_ids=./ids.txt
+# export V3_DATE_TO_EXCLUSIVE=1
+# export V3_DATE_TO_INCLUSIVE=1
+# export V3_PRINT_SQL=1
+# export V3_OTEL_ENDPOINT='http://localhost:4318'
+# export V3_OUTPUT=json
+# export V3_INCREMENTAL_FLOOR='2020-01-01'
+# export V3_DAILY_BREAKDOWN=1
+# export V3_ROW_NUMBER_TYPE=bigint
+# export V3_ROW_NUMBER_START=1
+# export V3_NO_TIME_RANGE_INDEX=1
+# export V3_NO_PROJECT_INDEX=1
+# export V3_BASE_SQL=base_metric
+# export V3_STRICT_TYPES=1
+# export V3_CONFLICT_WHERE="excluded.last_calculated_at > {{table}}.last_calculated_at"
+# export V3_PERCENTILE_COLUMN=contributions
+# export V3_PCT_OF_TOTAL='contributions:contributions_pct'
+# export V3_RECORD_DURATION=1
+# export V3_SCHEMA_VERSION=1
+# export V3_AUTO_MIGRATE=1
+# export V3_SURROGATE_KEY=1
+# export V3_OUTPUT=parquet
+# export V3_S3_BUCKET=metrics-lake
+# export V3_S3_KEY='{{metric}}/{{project_slug}}/{{time_range}}/{{date_from}}_{{date_to}}.parquet'
+# export V3_MAX_PLACEHOLDERS=32768
+# export V3_SNAPSHOT_ID='00000003-0000001B-1'
+# export V3_PROJECT_SLUGS='cncf-core:kubernetes,envoy;korg'
+# export V3_CREATE_LATEST_VIEW=1
+# export V3_AUTO_NAME_COLUMNS=1
+# export V3_MAINTENANCE_ONLY=1
+# export V3_MERGE_cnt=sum
+# export V3_NOT_NULL_COLUMNS='cnt,name'
+# export V3_NULLABLE_COLUMNS='avg_time'
+# export V3_DEPENDS_ON='sql:select max(updated_at) from activities'
+# export V3_DEPENDS_ON_COLUMN=updated_at
+# export V3_UNLOGGED=1
 # export V3_DEBUG=1
 ./calcmetric
@@ -1,49 +1,383 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/lib/pq"
 	lib "github.com/lukaszgryglicki/calcmetric"
+	"github.com/segmentio/kafka-go"
 )
 
 const (
 	gPrefix          = "V3_"
 	gMaxPlaceholders = 0x8000
+	// Postgres protocol limit of bind parameters in a single statement
+	gServerMaxPlaceholders = 65535
+	// two years of days
+	gMaxBreakdownDays = 731
 )
 
 var (
-	gRequired = []string{
-		"CONN",
+	gOrderByRe = regexp.MustCompile(`\border\s+by\b`)
+	// {{name|default}} param placeholders
+	gParamDefaultRe = regexp.MustCompile(`\{\{(\w+)\|([^}]*)\}\}`)
+	// -- @include other.sql lines in metric SQL files
+	gIncludeRe = regexp.MustCompile(`(?m)^[ \t]*--[ \t]*@include[ \t]+(\S+)[ \t]*$`)
+	// passwords in connect strings
+	gURLPasswordRe = regexp.MustCompile(`(://[^:/@\s]*):[^@\s]*@`)
+	gDSNPasswordRe = regexp.MustCompile(`password\s*=\s*('(\\.|[^'])*'|\S+)`)
+	// SQL string literals and table qualified column references (V3_CONFLICT_WHERE validation)
+	gSQLStringRe       = regexp.MustCompile(`'(''|[^'])*'`)
+	gQualifiedColumnRe = regexp.MustCompile(`("[^"]+"|[A-Za-z_]\w*)\s*\.\s*("[^"]+"|[A-Za-z_]\w*)\s*\(?`)
+	// schema version stored in the table comment (V3_SCHEMA_VERSION)
+	gSchemaVersionRe = regexp.MustCompile(`(?m)^schema_version: (\d+)$`)
+	// empty or numeric only column names, see columnName
+	gNumericNameRe = regexp.MustCompile(`^\d*$`)
+	// column types allowed for V3_MERGE_ sum, max and min
+	gNumericTypeRe = regexp.MustCompile(`^(smallint|int|integer|bigint|int2|int4|int8|real|double precision|float4|float8|numeric|decimal)(\s*\(.*\))?$`)
+	// Postgres duration accepted by V3_STATEMENT_TIMEOUT
+	gTimeoutRe = regexp.MustCompile(`^\d+\s*(ms|s|min|h|d)?$`)
+	// any {{placeholder}} left after rendering SQL
+	gPlaceholderRe = regexp.MustCompile(`\{\{[^{}]*\}\}`)
+	// allowed V3_COLUMN_TYPE_ overrides, optionally with type modifiers like numeric(10,2) or varchar(64)
+	gColumnTypeRe = regexp.MustCompile(`^(text|bool|boolean|date|interval|numeric|decimal|bytea|smallint|int|integer|bigint|real|double precision|float8|timestamp|timestamptz|json|jsonb|uuid|varchar|char)(\s*\(\s*\d+\s*(,\s*\d+\s*)?\))?$`)
+	gRequired     = []string{
 		"METRIC",
 		"TABLE",
 		"PROJECT_SLUG",
 		"TIME_RANGE",
 	}
-	// -1 - error
-	// 0 - ok, no calculations needed
-	// 1 - calculated
-	gFinalState = 0
+	// pairs of variables that cannot be set together and the reason why
+	gConflictingFlags = [][3]string{
+		{"PRINT_SQL", "PRINT_DDL", "PRINT_SQL only prints metric SQL, DDL would never be printed"},
+		{"PRINT_SQL", "CHECK_ONLY", "PRINT_SQL doesn't connect to the database, so setup would never be checked"},
+		{"TOUCH", "FORCE_CALC", "TOUCH only marks windows as calculated, it never calculates them"},
+		{"TOUCH", "DELETE", "TOUCH only marks windows as calculated, data would never be deleted"},
+		{"APPEND_ONLY", "CONFLICT_ACTION", "append only tables have no primary key, so there are no conflicts to handle"},
+		{"NO_PK", "CONFLICT_ACTION", "tables without primary key have no conflicts to handle"},
+		{"PROJECT_SLUG", "PROJECT_SLUGS", "PROJECT_SLUGS always wins, PROJECT_SLUG would be ignored"},
+		{"PROJECTS_SQL", "PROJECT_SLUGS", "PROJECTS_SQL always wins, PROJECT_SLUGS would be ignored"},
+		{"PROJECTS_SQL", "PROJECT_SLUG", "PROJECTS_SQL always wins, PROJECT_SLUG would be ignored"},
+		{"DAILY_BREAKDOWN", "DELTA_COLUMNS", "delta is calculated per period, not per day"},
+		{"APPEND_ONLY", "CONFLICT_WHERE", "append only tables have no primary key, so there are no conflicts to handle"},
+		{"NO_PK", "CONFLICT_WHERE", "tables without primary key have no conflicts to handle"},
+		{"SURROGATE_KEY", "NO_PK", "surrogate key is the primary key"},
+		{"SURROGATE_KEY", "CONFLICT_ACTION", "surrogate key tables use plain inserts, so there are no conflicts to handle"},
+		{"SURROGATE_KEY", "CONFLICT_WHERE", "surrogate key tables use plain inserts, so there are no conflicts to handle"},
+		{"BASE_SQL", "TOUCH", "TOUCH doesn't calculate anything, base SQL would be run for nothing"},
+		{"DATE_TO_INCLUSIVE", "DATE_TO_EXCLUSIVE", "both shift date_to by one day, stored date_to would no longer match the metric SQL window"},
+		{"MAINTENANCE_ONLY", "FORCE_CALC", "MAINTENANCE_ONLY never calculates"},
+		{"MAINTENANCE_ONLY", "TOUCH", "MAINTENANCE_ONLY never updates calculation state"},
+		{"MAINTENANCE_ONLY", "PRINT_SQL", "MAINTENANCE_ONLY doesn't render metric SQL"},
+		{"MAINTENANCE_ONLY", "PRINT_DDL", "MAINTENANCE_ONLY doesn't create tables"},
+	}
+	// lib.StateError, lib.StateNoop or lib.StateCalculated, mapped to the exit code by lib.ExitCode
+	gFinalState = lib.StateNoop
+	gMtx        = &sync.Mutex{}
+	// serializes daemon/listen mode calculations
+	gCalcMtx = &sync.Mutex{}
+	// traces calculation phases when V3_OTEL_ENDPOINT is set
+	gTracer *tracer
+	// JSON rows output (V3_OUTPUT=json)
+	gJSONOut *jsonRows
+	// variables that daemon/listen mode calculation request can set in its env
+	gRequestEnv = map[string]struct{}{
+		"FORCE_CALC": {},
+		"NOW":        {},
+		"DEBUG":      {},
+	}
+	// V3_BASE_SQL base tables created lazily by ensureBaseTable, keyed by {{base_table}} value
+	gBaseTables    = make(map[string]*lazyTable)
+	gBaseTablesMtx = &sync.Mutex{}
+	// files fetched from http(s) V3_SQL_PATH, reset on every run and daemon/listen request
+	gSQLCache    = make(map[string][]byte)
+	gSQLCacheMtx = &sync.Mutex{}
 )
 
+func setFinalState(state int) {
+	gMtx.Lock()
+	gFinalState = state
+	gMtx.Unlock()
+}
+
+func finalState() int {
+	gMtx.Lock()
+	defer gMtx.Unlock()
+	return gFinalState
+}
+
 func toDBIdentifier(arg string) string {
 	return strings.Replace(strings.ToLower(arg), "-", "_", -1)
 }
 
+// metricCond returns condition limiting rows to the current metric (with V3_STORE_METRIC_NAME) using $n placeholder
+// and its argument, or an empty condition and no arguments otherwise
+func metricCond(n int, env map[string]string) (string, []interface{}) {
+	_, storeMetric := env["STORE_METRIC_NAME"]
+	if !storeMetric {
+		return "", []interface{}{}
+	}
+	metric, _ := env["METRIC"]
+	return fmt.Sprintf(" and metric = $%d", n), []interface{}{metric}
+}
+
+// sqlPath returns directory containing metric SQL files
+func sqlPath(env map[string]string) string {
+	path, ok := env["SQL_PATH"]
+	if !ok {
+		path = "./sql/"
+	}
+	return path
+}
+
+// metricFile returns path of a metric file with a given extension, name can contain subdirectories (like growth/new_contributors)
+// but it cannot point outside of V3_SQL_PATH
+func metricFile(env map[string]string, name, ext string) (string, error) {
+	clean := filepath.ToSlash(filepath.Clean(name))
+	if filepath.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("metric '%s' points outside of %sSQL_PATH", name, gPrefix)
+	}
+	return sqlPath(env) + clean + ext, nil
+}
+
+// readMetricSQL reads SQL file for a given metric name
+func readMetricSQL(env map[string]string, name string) ([]byte, error) {
+	path, err := metricFile(env, name, ".sql")
+	if err != nil {
+		return nil, err
+	}
+	return readSQLFile(env, path)
+}
+
+// isURL returns true when V3_SQL_PATH (or file path) is an http(s) URL
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// readSQLFile reads a local file or fetches it over HTTP when V3_SQL_PATH is an http(s) URL
+// V3_SQL_AUTH_HEADER (Name: value) is sent with the request, fetched files are cached for the run
+// 404 is reported as a not existing file, any other non-200 response is an error
+func readSQLFile(env map[string]string, path string) ([]byte, error) {
+	if !isURL(path) {
+		return ioutil.ReadFile(path)
+	}
+	gSQLCacheMtx.Lock()
+	contents, ok := gSQLCache[path]
+	gSQLCacheMtx.Unlock()
+	if ok {
+		return contents, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	authHeader, _ := env["SQL_AUTH_HEADER"]
+	if authHeader != "" {
+		ary := strings.SplitN(authHeader, ":", 2)
+		if len(ary) < 2 || strings.TrimSpace(ary[0]) == "" {
+			return nil, fmt.Errorf("%sSQL_AUTH_HEADER must be in 'Name: value' format", gPrefix)
+		}
+		req.Header.Set(strings.TrimSpace(ary[0]), strings.TrimSpace(ary[1]))
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch '%s': %+v", path, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: "get", Path: path, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching '%s' returned %s", path, resp.Status)
+	}
+	contents, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch '%s': %+v", path, err)
+	}
+	gSQLCacheMtx.Lock()
+	gSQLCache[path] = contents
+	gSQLCacheMtx.Unlock()
+	return contents, nil
+}
+
+// includeSQL reads metric SQL file and recursively expands `-- @include other.sql` lines with included files contents
+// included file names are relative to V3_SQL_PATH, stack holds files being expanded to detect include cycles
+func includeSQL(env map[string]string, name string, stack []string) (string, error) {
+	for _, item := range stack {
+		if item == name {
+			return "", fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), name)
+		}
+	}
+	contents, err := readMetricSQL(env, name)
+	if err != nil {
+		return "", err
+	}
+	stack = append(stack, name)
+	var rerr error
+	sql := gIncludeRe.ReplaceAllStringFunc(string(contents), func(match string) string {
+		if rerr != nil {
+			return match
+		}
+		included := strings.TrimSuffix(gIncludeRe.FindStringSubmatch(match)[1], ".sql")
+		expanded, err := includeSQL(env, included, stack)
+		if err != nil {
+			rerr = err
+			return match
+		}
+		return strings.TrimRight(expanded, "\n")
+	})
+	if rerr != nil {
+		return "", rerr
+	}
+	return sql, nil
+}
+
+// loadMetricParams sets default V3_PARAM_xyz values from the optional metric params file (metric.params next to metric.sql)
+// it has key=value lines (empty lines and lines starting with # are skipped), values from environment take precedence
+func loadMetricParams(env map[string]string, debug bool) error {
+	metric, _ := env["METRIC"]
+	path, err := metricFile(env, metric, ".params")
+	if err != nil {
+		return err
+	}
+	contents, err := readSQLFile(env, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ary := strings.SplitN(line, "=", 2)
+		if len(ary) < 2 || strings.TrimSpace(ary[0]) == "" {
+			return fmt.Errorf("%s:%d: expected key=value, got: '%s'", path, i+1, line)
+		}
+		key := "PARAM_" + strings.TrimSpace(ary[0])
+		_, ok := env[key]
+		if ok {
+			continue
+		}
+		env[key] = strings.TrimSpace(ary[1])
+		if debug {
+			lib.Logf("%s%s=%s from '%s'\n", gPrefix, key, env[key], path)
+		}
+	}
+	return nil
+}
+
+// assertSQLHash checks if metric SQL file has the expected hash (V3_ASSERT_SQL_HASH)
+// hash can be MD5 (32 hex digits) or SHA256 (64 hex digits)
+func assertSQLHash(env map[string]string) error {
+	expected, _ := env["ASSERT_SQL_HASH"]
+	if expected == "" {
+		return nil
+	}
+	metric, _ := env["METRIC"]
+	if len(metricsList(env)) > 1 {
+		return fmt.Errorf("%sASSERT_SQL_HASH cannot be used with multiple metrics: '%s'", gPrefix, metric)
+	}
+	contents, err := readMetricSQL(env, metric)
+	if err != nil {
+		return err
+	}
+	expected = strings.ToLower(strings.TrimSpace(expected))
+	actual := ""
+	switch len(expected) {
+	case 32:
+		actual = fmt.Sprintf("%x", md5.Sum(contents))
+	case 64:
+		actual = fmt.Sprintf("%x", sha256.Sum256(contents))
+	default:
+		return fmt.Errorf("%sASSERT_SQL_HASH must be MD5 or SHA256 hex digest, got: '%s'", gPrefix, expected)
+	}
+	if actual != expected {
+		return fmt.Errorf("metric '%s' SQL file hash is %s, expected %s, SQL file is probably stale", metric, actual, expected)
+	}
+	return nil
+}
+
+// metricVersion returns fingerprint (MD5) of the metric SQL file (before any substitutions) when V3_VERSIONED_SQL is set
+// otherwise it returns an empty string
+func metricVersion(env map[string]string) (string, error) {
+	_, versioned := env["VERSIONED_SQL"]
+	if !versioned {
+		return "", nil
+	}
+	// included files are part of the version, so changing a shared fragment makes rows stale too
+	metric, _ := env["METRIC"]
+	contents, err := includeSQL(env, metric, []string{})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(contents))), nil
+}
+
+// dateBinds returns date_from and date_to bind values for comparing with (and storing into) date columns
+// both are rounded to day start and formatted as YYYY-MM-DD, so values stored by calculate compare equal in isCalculated
+// date_to is the exclusive period end, with V3_DATE_TO_INCLUSIVE it is the last day of the period instead
+func dateBinds(dtf, dtt time.Time, env map[string]string) (string, string) {
+	_, inclusive := env["DATE_TO_INCLUSIVE"]
+	if inclusive {
+		dtt = lib.PrevDayStart(dtt)
+	}
+	return lib.ToYMD(lib.DayStart(dtf)), lib.ToYMD(lib.DayStart(dtt))
+}
+
 func isCalculated(db *sql.DB, table, projectSlug, timeRange string, debug bool, env map[string]string, dtf, dtt time.Time) (bool, error) {
-	dtf = lib.DayStart(dtf)
-	// dtt = lib.NextDayStart(dtt)
-	dtt = lib.DayStart(dtt)
+	stateTable, _ := env["STATE_TABLE"]
+	if stateTable != "" {
+		table = stateTable
+	}
+	df, dt := dateBinds(dtf, dtt, env)
+	mCond, mArgs := metricCond(5, env)
+	args := append([]interface{}{projectSlug, timeRange, df, dt}, mArgs...)
+	// rows calculated using a different metric SQL version are stale
+	version, err := metricVersion(env)
+	if err != nil {
+		return false, err
+	}
+	if version != "" {
+		args = append(args, version)
+		mCond += fmt.Sprintf(" and metric_version = $%d", len(args))
+	}
 	sqlQuery := fmt.Sprintf(
-		`select last_calculated_at from "%s" where project_slug = $1 and time_range = $2 and date_from = $3 and date_to = $4`,
+		`select last_calculated_at from "%s" where project_slug = $1 and time_range = $2 and date_from = $3 and date_to = $4%s`,
 		table,
+		mCond,
 	)
-	args := []interface{}{projectSlug, timeRange, dtf, dtt}
 	if debug {
 		lib.Logf("executing sql: %s\nwith args: %+v\n", sqlQuery, args)
 	}
@@ -56,11 +390,16 @@ func isCalculated(db *sql.DB, table, projectSlug, timeRange string, debug bool,
 				lib.Logf("table '%s' does not exist yet, so we need to calculate this metric.\n", table)
 				return false, nil
 			}
+			// table created by an older version (for example without last_calculated_at) - recalculate
+			if errName == "undefined_column" {
+				lib.Logf("table '%s' is missing some columns (%s), so we need to calculate this metric, you may need to add them manually or use %sDROP.\n", table, e.Message, gPrefix)
+				return false, nil
+			}
 			lib.QueryOut(sqlQuery, args...)
-			return false, err
+			return false, &lib.ErrQuery{Query: sqlQuery, Err: err}
 		default:
 			lib.QueryOut(sqlQuery, args...)
-			return false, err
+			return false, &lib.ErrQuery{Query: sqlQuery, Err: err}
 		}
 	}
 	defer func() { _ = rows.Close() }()
@@ -80,18 +419,125 @@ func isCalculated(db *sql.DB, table, projectSlug, timeRange string, debug bool,
 		return false, err
 	}
 	if fetched {
-		lib.Logf("table '%s' was last computed at %+v for (%s, %s, %+v, %+v), so calculation is not needed\n", table, lastCalc, projectSlug, timeRange, dtf, dtt)
+		changed, err := dependencyChanged(db, lastCalc, debug, env)
+		if err != nil {
+			return false, err
+		}
+		if changed {
+			lib.Logf("table '%s' was last computed at %+v for (%s, %s, %s, %s), but %sDEPENDS_ON data changed since then, so it needs calculation\n", table, lastCalc, projectSlug, timeRange, df, dt, gPrefix)
+			return false, nil
+		}
+		lib.Logf("table '%s' was last computed at %+v for (%s, %s, %s, %s), so calculation is not needed\n", table, lastCalc, projectSlug, timeRange, df, dt)
 		return true, nil
 	}
-	lib.Logf("table '%s' present, but it needs calculation for (%s, %s, %+v, %+v)\n", table, projectSlug, timeRange, dtf, dtt)
+	lib.Logf("table '%s' present, but it needs calculation for (%s, %s, %s, %s)\n", table, projectSlug, timeRange, df, dt)
+	return false, nil
+}
+
+// dependencyChanged returns true when V3_DEPENDS_ON data was updated after lastCalc
+// V3_DEPENDS_ON is a comma separated list of tables, their max(V3_DEPENDS_ON_COLUMN) (default updated_at) is checked,
+// or "sql:query" returning a single timestamp, empty dependency (null) is never considered changed
+func dependencyChanged(db *sql.DB, lastCalc time.Time, debug bool, env map[string]string) (bool, error) {
+	dependsOn, _ := env["DEPENDS_ON"]
+	if dependsOn == "" {
+		return false, nil
+	}
+	queries := []string{}
+	if strings.HasPrefix(dependsOn, "sql:") {
+		queries = append(queries, dependsOn[4:])
+	} else {
+		column, _ := env["DEPENDS_ON_COLUMN"]
+		if column == "" {
+			column = "updated_at"
+		}
+		for _, table := range strings.Split(dependsOn, ",") {
+			queries = append(queries, fmt.Sprintf(`select max(%s) from "%s"`, column, strings.TrimSpace(table)))
+		}
+	}
+	for _, query := range queries {
+		var updated sql.NullTime
+		err := db.QueryRow(query).Scan(&updated)
+		if err != nil {
+			lib.QueryOut(query, []interface{}{}...)
+			return false, fmt.Errorf("cannot check %sDEPENDS_ON: %+v", gPrefix, err)
+		}
+		if debug {
+			lib.Logf("dependency updated at %+v (valid: %v), last calculated at %+v: %s\n", updated.Time, updated.Valid, lastCalc, query)
+		}
+		if updated.Valid && updated.Time.After(lastCalc) {
+			return true, nil
+		}
+	}
 	return false, nil
 }
 
+// columnType returns output column type: V3_COLUMN_TYPE_<colName> override if set, otherwise type inferred from the driver
+// colName is the stored column name (see columnName), so auto named columns can be overridden too
+func columnType(column *sql.ColumnType, colName string, env map[string]string) (string, error) {
+	override, ok := env["COLUMN_TYPE_"+colName]
+	if !ok {
+		return dbTypeName(column, env)
+	}
+	tp := strings.ToLower(strings.TrimSpace(override))
+	if !gColumnTypeRe.MatchString(tp) {
+		return "error", fmt.Errorf("unsupported type '%s' specified in %sCOLUMN_TYPE_%s", override, gPrefix, colName)
+	}
+	return tp, nil
+}
+
+// columnName returns n-th metric column name, names generated for unaliased expressions (?column?, empty or numeric)
+// are replaced with col_<n> when V3_AUTO_NAME_COLUMNS is set, otherwise they are an error
+func columnName(name string, n int, env map[string]string) (string, error) {
+	if name != "?column?" && !gNumericNameRe.MatchString(name) {
+		return name, nil
+	}
+	_, autoName := env["AUTO_NAME_COLUMNS"]
+	if !autoName {
+		return "", fmt.Errorf("metric column %d has no name ('%s'), add an alias to the expression (for example: count(*) as cnt) or use %sAUTO_NAME_COLUMNS", n, name, gPrefix)
+	}
+	autoNamed := fmt.Sprintf("col_%d", n)
+	lib.Logf("warning: metric column %d has no name ('%s'), using '%s' (%sAUTO_NAME_COLUMNS)\n", n, name, autoNamed, gPrefix)
+	return autoNamed, nil
+}
+
+// rowNumberOptions returns row_number column type (V3_ROW_NUMBER_TYPE, default bigint) and its starting value (V3_ROW_NUMBER_START, default 1)
+// Type only matters when the table (or materialized view) is created, existing tables keep their row_number type
+func rowNumberOptions(env map[string]string) (string, int, error) {
+	tp := "bigint"
+	t, _ := env["ROW_NUMBER_TYPE"]
+	if t != "" {
+		tp = strings.ToLower(strings.TrimSpace(t))
+		if tp == "integer" {
+			tp = "int"
+		}
+		if tp != "int" && tp != "bigint" {
+			return "", 0, fmt.Errorf("%sROW_NUMBER_TYPE must be int or bigint, got: %s", gPrefix, t)
+		}
+	}
+	start := 1
+	s, _ := env["ROW_NUMBER_START"]
+	if s != "" {
+		var err error
+		start, err = strconv.Atoi(s)
+		if err != nil {
+			return "", 0, err
+		}
+		if start < 0 {
+			return "", 0, fmt.Errorf("%sROW_NUMBER_START must be a non-negative number, got: %d", gPrefix, start)
+		}
+	}
+	summary, _ := env["SUMMARY_METRIC"]
+	if summary != "" && start == 0 {
+		return "", 0, fmt.Errorf("%sROW_NUMBER_START=0 cannot be used with %sSUMMARY_METRIC, summary row uses row_number 0", gPrefix, gPrefix)
+	}
+	return tp, start, nil
+}
+
 func dbTypeName(column *sql.ColumnType, env map[string]string) (string, error) {
 	_, guess := env["GUESS_TYPE"]
 	name := strings.ToLower(column.DatabaseTypeName())
 	switch name {
-	case "text", "bool", "date", "interval", "numeric":
+	case "text", "bool", "date", "interval", "numeric", "bytea":
 		return name, nil
 	case "varchar":
 		return "text", nil
@@ -102,25 +548,104 @@ func dbTypeName(column *sql.ColumnType, env map[string]string) (string, error) {
 	case "float8":
 		return "numeric", nil
 	default:
-		if guess {
+		// V3_STRICT_TYPES turns guessed types into errors, so unexpected types are caught before they reach production
+		_, strict := env["STRICT_TYPES"]
+		if guess && !strict {
+			lib.Logf("warning: column '%s' has unknown type '%s', using it as is (%sGUESS_TYPE)\n", column.Name(), name, gPrefix)
 			return name, nil
 		}
+		if guess {
+			return "error", fmt.Errorf("column '%s' has unknown type '%s', not guessing it because %sSTRICT_TYPES is set", column.Name(), name, gPrefix)
+		}
 		return "error", fmt.Errorf("unknown type: '%s' in %+v", name, column)
 	}
 }
 
-func supportCleanup(db *sql.DB, table, timeRange, projectSlug string, dtf, dtt time.Time, debug bool, env map[string]string) {
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// columnValue returns value to bind for a scanned column, compressed columns are gzipped and bound as bytea
+func columnValue(raw *sql.RawBytes, compress bool) (interface{}, error) {
+	if !compress {
+		return string(*raw), nil
+	}
+	if *raw == nil {
+		return nil, nil
+	}
+	return gzipBytes(*raw)
+}
+
+// newScanDest returns scan destination for a column, with typed scan it is a type appropriate sql.Null* value
+// otherwise (and for compressed columns) sql.RawBytes which is then bound as a string
+// bytea columns are always scanned into []byte and bound as bytes
+func newScanDest(column *sql.ColumnType, typed, compress bool) interface{} {
+	if compress {
+		return new(sql.RawBytes)
+	}
+	name := strings.ToLower(column.DatabaseTypeName())
+	if name == "bytea" {
+		return new([]byte)
+	}
+	if !typed {
+		return new(sql.RawBytes)
+	}
+	switch name {
+	case "int2", "int4", "int8":
+		return new(sql.NullInt64)
+	case "float4", "float8":
+		return new(sql.NullFloat64)
+	case "bool":
+		return new(sql.NullBool)
+	case "date", "timestamp", "timestamptz":
+		return new(sql.NullTime)
+	default:
+		// numeric is scanned as a string to keep its exact precision
+		return new(sql.NullString)
+	}
+}
+
+// scannedValue returns value to bind for a scanned destination created by newScanDest
+func scannedValue(dest interface{}, compress bool) (interface{}, error) {
+	switch v := dest.(type) {
+	case *sql.RawBytes:
+		return columnValue(v, compress)
+	case *[]byte:
+		if *v == nil {
+			return nil, nil
+		}
+		return *v, nil
+	case driver.Valuer:
+		return v.Value()
+	default:
+		return nil, fmt.Errorf("unsupported scan destination: %T", dest)
+	}
+}
+
+// supportCleanup deletes rows of older date ranges (V3_CLEANUP), returns true when any rows were deleted
+func supportCleanup(db *sql.DB, table, timeRange, projectSlug string, dtf, dtt time.Time, debug bool, env map[string]string) bool {
 	cl, clOK := env["CLEANUP"]
 	if !clOK || cl == "" {
-		return
+		return false
 	}
-	dtf = lib.DayStart(dtf)
-	dtt = lib.DayStart(dtt)
+	df, dt := dateBinds(dtf, dtt, env)
+	mCond, mArgs := metricCond(5, env)
 	delQuery := fmt.Sprintf(
-		`delete from "%s" where time_range = $1 and project_slug = $2 and date_from < $3 and date_to < $4 and date(last_calculated_at) < date(now())`,
+		`delete from "%s" where time_range = $1 and project_slug = $2 and date_from < $3 and date_to < $4 and date(last_calculated_at) < date(now())%s`,
 		table,
+		mCond,
 	)
-	args := []interface{}{timeRange, projectSlug, dtf, dtt}
+	args := append([]interface{}{timeRange, projectSlug, df, dt}, mArgs...)
 	if debug {
 		lib.Logf("cleanup: delete from table:\n%s\n%+v\n", delQuery, args)
 	}
@@ -128,13 +653,33 @@ func supportCleanup(db *sql.DB, table, timeRange, projectSlug string, dtf, dtt t
 	if err != nil {
 		lib.Logf("error: %+v\n", err)
 		lib.QueryOut(delQuery, args...)
-		return
+		return false
 	}
+	cleaned := false
 	rows, err := res.RowsAffected()
 	if err == nil && rows > 0 {
-		lib.Logf("cleanup %d rows from \"%s\"(%s, %s, <%+v, <%+v)\n", rows, table, projectSlug, timeRange, dtf, dtt)
+		lib.Logf("cleanup %d rows from \"%s\"(%s, %s, <%s, <%s)\n", rows, table, projectSlug, timeRange, df, dt)
+		cleaned = true
+	}
+	stateTable, _ := env["STATE_TABLE"]
+	if stateTable != "" && stateTable != table {
+		supportCleanup(db, stateTable, timeRange, projectSlug, dtf, dtt, debug, env)
+	}
+	return cleaned
+}
+
+// maintainRange only runs V3_DELETE and V3_CLEANUP for a given range (V3_MAINTENANCE_ONLY), metric is not calculated
+// final state is calculated when any rows were deleted
+func maintainRange(db *sql.DB, table, projectSlug, timeRange string, dtf, dtt time.Time, matview, debug bool, env map[string]string) {
+	if matview {
+		return
+	}
+	deleted := supportDelete(db, table, timeRange, projectSlug, dtf, dtt, debug, env)
+	cleaned := supportCleanup(db, table, timeRange, projectSlug, dtf, dtt, debug, env)
+	if deleted || cleaned {
+		lib.Logf("maintenance: removed rows from '%s' (%s, %s)\n", table, projectSlug, timeRange)
+		setFinalState(lib.StateCalculated)
 	}
-	return
 }
 
 func supportDelete(db *sql.DB, table, timeRange, projectSlug string, dtf, dtt time.Time, debug bool, env map[string]string) bool {
@@ -151,6 +696,7 @@ func supportDelete(db *sql.DB, table, timeRange, projectSlug string, dtf, dtt ti
 		lib.Logf("unconditioned DELETE is not suppored - you probably mean something else, use DROP to do a full table delete instead\n")
 		return false
 	}
+	dfs, dts := dateBinds(dtf, dtt, env)
 	args := []interface{}{}
 	delQuery := fmt.Sprintf(`delete from "%s"`, table)
 	// tr,ps,df,dt
@@ -173,13 +719,19 @@ func supportDelete(db *sql.DB, table, timeRange, projectSlug string, dtf, dtt ti
 	if df {
 		i++
 		conds = append(conds, fmt.Sprintf("date_from = $%d", i))
-		args = append(args, dtf)
+		args = append(args, dfs)
 	}
 	_, dt := delMap["dt"]
 	if dt {
 		i++
 		conds = append(conds, fmt.Sprintf("date_to = $%d", i))
-		args = append(args, dtt)
+		args = append(args, dts)
+	}
+	// when multiple metrics share a table, only delete current metric's rows
+	mCond, mArgs := metricCond(i+1, env)
+	if mCond != "" {
+		conds = append(conds, strings.TrimPrefix(mCond, " and "))
+		args = append(args, mArgs...)
 	}
 	if len(conds) > 0 {
 		cond = strings.Join(conds, " and ")
@@ -194,6 +746,16 @@ func supportDelete(db *sql.DB, table, timeRange, projectSlug string, dtf, dtt ti
 		lib.QueryOut(delQuery, args...)
 		return false
 	}
+	// calculation state must be deleted together with data, so deleted data gets recalculated
+	stateTable, _ := env["STATE_TABLE"]
+	if stateTable != "" {
+		stateQuery := strings.Replace(delQuery, fmt.Sprintf(`"%s"`, table), fmt.Sprintf(`"%s"`, stateTable), 1)
+		_, err = db.Exec(stateQuery, args...)
+		if err != nil {
+			lib.Logf("error: %+v\n", err)
+			lib.QueryOut(stateQuery, args...)
+		}
+	}
 	rows, err := res.RowsAffected()
 	if err == nil {
 		return rows > 0
@@ -201,537 +763,5039 @@ func supportDelete(db *sql.DB, table, timeRange, projectSlug string, dtf, dtt ti
 	return false
 }
 
-func calculate(db *sql.DB, sqlQuery, table, projectSlug, timeRange, dtFrom, dtTo string, ppt, debug bool, env map[string]string) error {
-	rows, err := db.Query(sqlQuery)
-	if err != nil {
-		lib.QueryOut(sqlQuery, []interface{}{}...)
-		return err
+// gDateStyle is used on both the source and the write connections, so date/timestamp text values round-trip
+// regardless of server's locale/DateStyle
+const gDateStyle = "set DateStyle to 'ISO, YMD'"
+
+// sessionStatements returns semicolon separated statements from V3_SESSION_SQL
+// preceded by setting DateStyle, search_path when V3_SEARCH_PATH is set and statement_timeout when V3_STATEMENT_TIMEOUT is set
+func sessionStatements(env map[string]string) []string {
+	stmts := []string{gDateStyle}
+	searchPath, _ := env["SEARCH_PATH"]
+	if searchPath != "" {
+		stmts = append(stmts, "set search_path to "+searchPath)
 	}
-	defer func() { _ = rows.Close() }()
-	columns, err := rows.ColumnTypes()
-	if err != nil {
-		return err
+	timeout, _ := env["STATEMENT_TIMEOUT"]
+	if timeout != "" {
+		stmts = append(stmts, "set statement_timeout to "+pq.QuoteLiteral(timeout))
 	}
-	if debug {
-		lib.Logf("columns: %d\n", len(columns))
-		for _, column := range columns {
-			lib.Logf("%+v\n", column)
+	sessionSQL, _ := env["SESSION_SQL"]
+	for _, stmt := range strings.Split(sessionSQL, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt != "" {
+			stmts = append(stmts, stmt)
 		}
 	}
-	indicesAry := []string{}
-	indices, ok := env["INDEXED_COLUMNS"]
-	if ok && indices != "" {
-		indicesAry = strings.Split(indices, ",")
+	return stmts
+}
+
+// sourceConn returns a dedicated connection for the metric query with session settings applied
+// database/sql pools connections, so settings must be applied on the same connection that runs the query
+func sourceConn(ctx context.Context, db *sql.DB, debug bool, env map[string]string) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timeout, _ := env["STATEMENT_TIMEOUT"]
+	if debug && timeout != "" {
+		lib.Logf("source query statement timeout: %s\n", timeout)
+	}
+	for _, stmt := range sessionStatements(env) {
 		if debug {
-			lib.Logf("extra indices requested: %+v\n", indicesAry)
+			lib.Logf("session SQL: %s\n", stmt)
 		}
-	}
-	createTable := fmt.Sprintf(`create table if not exists "%s"(
-  time_range varchar(6) not null,
-  project_slug text not null,
-  last_calculated_at timestamp not null,
-  date_from date not null,
-  date_to date not null,
-  row_number int not null,
-`,
-		table,
-	)
-	l := len(columns) - 1
-	colNames := []string{}
-	namesMap := make(map[string]struct{})
-	for i, column := range columns {
-		tp, err := dbTypeName(column, env)
+		_, err = conn.ExecContext(ctx, stmt)
 		if err != nil {
-			return err
+			lib.QueryOut(stmt, []interface{}{}...)
+			_ = conn.Close()
+			return nil, err
 		}
-		colName := column.Name()
-		_, ok := namesMap[colName]
-		if ok {
-			return fmt.Errorf("non unique column name '%s'", colName)
+	}
+	// metric is calculated against a snapshot exported by another transaction (pg_export_snapshot())
+	// so multiple metrics (or other jobs) can see exactly the same source state
+	snapshot, _ := env["SNAPSHOT_ID"]
+	if snapshot != "" {
+		for _, stmt := range []string{"begin isolation level repeatable read read only", "set transaction snapshot " + pq.QuoteLiteral(snapshot)} {
+			if debug {
+				lib.Logf("snapshot SQL: %s\n", stmt)
+			}
+			_, err = conn.ExecContext(ctx, stmt)
+			if err != nil {
+				lib.QueryOut(stmt, []interface{}{}...)
+				_, _ = conn.ExecContext(ctx, "rollback")
+				_ = conn.Close()
+				return nil, fmt.Errorf("cannot use %sSNAPSHOT_ID '%s': %+v", gPrefix, snapshot, err)
+			}
 		}
-		namesMap[colName] = struct{}{}
-		colNames = append(colNames, colName)
-		createTable += fmt.Sprintf(`  %s %s`, colName, tp)
-		nullable, ok := column.Nullable()
-		if ok && !nullable {
-			createTable += ` not null`
+		lib.Logf("source query uses snapshot '%s'\n", snapshot)
+	}
+	return conn, nil
+}
+
+// releaseConn ends the snapshot transaction (if any), resets session settings (so they don't leak to other pooled queries)
+// and returns connection to the pool
+func releaseConn(ctx context.Context, conn *sql.Conn, env map[string]string) {
+	snapshot, _ := env["SNAPSHOT_ID"]
+	if snapshot != "" {
+		_, _ = conn.ExecContext(ctx, "rollback")
+	}
+	_, _ = conn.ExecContext(ctx, "reset all")
+	_ = conn.Close()
+}
+
+// maxPlaceholders returns maximum number of bind parameters used by a single batch: V3_MAX_PLACEHOLDERS (default gMaxPlaceholders)
+// values above the server limit would fail with "too many parameters" error, so they are capped
+func maxPlaceholders(env map[string]string) (int, error) {
+	mp, _ := env["MAX_PLACEHOLDERS"]
+	if mp == "" {
+		return gMaxPlaceholders, nil
+	}
+	maxP, err := strconv.Atoi(mp)
+	if err != nil {
+		return 0, err
+	}
+	if maxP <= 0 {
+		return 0, fmt.Errorf("%sMAX_PLACEHOLDERS must be a positive number, got: %d", gPrefix, maxP)
+	}
+	if maxP > gServerMaxPlaceholders {
+		lib.Logf("warning: %sMAX_PLACEHOLDERS=%d exceeds the server limit of %d bind parameters, capping batches at %d\n", gPrefix, maxP, gServerMaxPlaceholders, gServerMaxPlaceholders)
+		maxP = gServerMaxPlaceholders
+	}
+	return maxP, nil
+}
+
+// nullabilityOverrides returns columns from V3_NOT_NULL_COLUMNS and V3_NULLABLE_COLUMNS, a column cannot be in both
+func nullabilityOverrides(env map[string]string) (map[string]struct{}, map[string]struct{}, error) {
+	maps := [2]map[string]struct{}{make(map[string]struct{}), make(map[string]struct{})}
+	for i, key := range []string{"NOT_NULL_COLUMNS", "NULLABLE_COLUMNS"} {
+		cols, _ := env[key]
+		for _, colName := range strings.Split(cols, ",") {
+			colName = strings.TrimSpace(colName)
+			if colName != "" {
+				maps[i][colName] = struct{}{}
+			}
 		}
-		if i < l {
-			createTable += ",\n"
-		} else {
-			createTable += `,
-  primary key(time_range, project_slug, date_from, date_to, row_number)
-);
-`
+	}
+	for colName := range maps[0] {
+		_, ok := maps[1][colName]
+		if ok {
+			return nil, nil, fmt.Errorf("column '%s' cannot be specified in both %sNOT_NULL_COLUMNS and %sNULLABLE_COLUMNS", colName, gPrefix, gPrefix)
 		}
 	}
-	createTable += fmt.Sprintf(`create index if not exists "%s_time_range_idx" on "%s"(time_range);
-`,
-		table,
-		table,
-	)
-	if !ppt {
-		createTable += fmt.Sprintf(`create index if not exists "%s_project_slug_idx" on "%s"(project_slug);
-`,
-			table,
-			table,
-		)
+	return maps[0], maps[1], nil
+}
+
+// checkTimeouts validates V3_STATEMENT_TIMEOUT and V3_LOCK_TIMEOUT: Postgres duration, milliseconds when no unit is given
+func checkTimeouts(env map[string]string) error {
+	for _, key := range []string{"STATEMENT_TIMEOUT", "LOCK_TIMEOUT"} {
+		timeout, _ := env[key]
+		if timeout != "" && !gTimeoutRe.MatchString(timeout) {
+			return fmt.Errorf("%s%s must be a number of milliseconds or a number with unit (ms, s, min, h, d), got: '%s'", gPrefix, key, timeout)
+		}
 	}
-	for _, index := range indicesAry {
-		createTable += fmt.Sprintf(`create index if not exists "%s_%s_idx" on "%s"(%s);
-`,
-			table,
-			index,
-			table,
-			index,
-		)
+	return nil
+}
+
+// lockTimeoutSQL returns statement setting V3_LOCK_TIMEOUT for the current transaction, empty when not set
+func lockTimeoutSQL(env map[string]string) string {
+	timeout, _ := env["LOCK_TIMEOUT"]
+	if timeout == "" {
+		return ""
 	}
-	if debug {
-		lib.Logf("create table:\n%s\n", createTable)
+	return "set local lock_timeout to " + pq.QuoteLiteral(timeout)
+}
+
+// logLockTimeout explains lock_not_available errors caused by V3_LOCK_TIMEOUT
+func logLockTimeout(err error, env map[string]string) {
+	var e *pq.Error
+	if errors.As(err, &e) && e.Code.Name() == "lock_not_available" {
+		timeout, _ := env["LOCK_TIMEOUT"]
+		lib.Logf("could not acquire a lock within %sLOCK_TIMEOUT=%s, the table is probably used by a long running query, retry later\n", gPrefix, timeout)
+	}
+}
+
+// execDDL executes DDL statement, with V3_LOCK_TIMEOUT it runs in a transaction with lock_timeout set
+// so it fails fast instead of waiting behind long running queries holding locks
+func execDDL(db *sql.DB, query string, env map[string]string) error {
+	lockTimeout := lockTimeoutSQL(env)
+	if lockTimeout == "" {
+		_, err := db.Exec(query)
+		return err
 	}
-	_, err = db.Exec(createTable)
+	tx, err := db.Begin()
 	if err != nil {
-		lib.QueryOut(createTable, []interface{}{}...)
 		return err
 	}
-	i := 0
-	nColumns := len(columns)
-	pValues := make([]interface{}, nColumns)
-	for i := range columns {
-		pValues[i] = new(sql.RawBytes)
+	for _, stmt := range []string{lockTimeout, query} {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			_ = tx.Rollback()
+			logLockTimeout(err, env)
+			return err
+		}
 	}
-	calcDt := time.Now()
-	p := 0
-	ep := 0
-	changes := false
-	// This is the type of query that we will be using (UPSERT):
-	// insert into t(a, b, c) values (1, 2, 30), (4, 5, 60) on conflict(a, b) do update set (b, c) = (excluded.b, excluded.c);
-	queryRoot := fmt.Sprintf(`insert into "%s"(time_range, project_slug, last_calculated_at, date_from, date_to, row_number, `, table)
-	query := ""
-	args := []interface{}{}
-	batches := 0
-	for rows.Next() {
-		err := rows.Scan(pValues...)
+	return tx.Commit()
+}
+
+// expectedRows returns V3_EXPECT_MIN_ROWS and V3_EXPECT_MAX_ROWS bounds of the metric rows count, 0 means no bound
+func expectedRows(env map[string]string) (int, int, error) {
+	bounds := [2]int{}
+	for i, key := range []string{"EXPECT_MIN_ROWS", "EXPECT_MAX_ROWS"} {
+		v, _ := env[key]
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, &lib.ErrParse{What: gPrefix + key, Err: err}
+		}
+		if n < 0 {
+			return 0, 0, fmt.Errorf("%s%s cannot be negative, got: %d", gPrefix, key, n)
+		}
+		bounds[i] = n
+	}
+	if bounds[1] > 0 && bounds[0] > bounds[1] {
+		return 0, 0, fmt.Errorf("%sEXPECT_MIN_ROWS=%d is greater than %sEXPECT_MAX_ROWS=%d", gPrefix, bounds[0], gPrefix, bounds[1])
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// checkExpectedRows returns an error when the metric rows count is outside of V3_EXPECT_MIN_ROWS - V3_EXPECT_MAX_ROWS
+func checkExpectedRows(nRows int, env map[string]string) error {
+	minRows, maxRows, err := expectedRows(env)
+	if err != nil {
+		return err
+	}
+	if minRows > 0 && nRows < minRows {
+		return fmt.Errorf("metric returned %d rows, expected at least %d (%sEXPECT_MIN_ROWS)", nRows, minRows, gPrefix)
+	}
+	if maxRows > 0 && nRows > maxRows {
+		return fmt.Errorf("metric returned %d rows, expected at most %d (%sEXPECT_MAX_ROWS)", nRows, maxRows, gPrefix)
+	}
+	return nil
+}
+
+// percentileColumn returns V3_PERCENTILE_COLUMN, percentile is calculated over all rows, so it cannot be used with paginated metrics
+func percentileColumn(env map[string]string) (string, error) {
+	col, _ := env["PERCENTILE_COLUMN"]
+	col = strings.TrimSpace(col)
+	if col == "" {
+		return "", nil
+	}
+	for _, key := range []string{"LIMIT", "OFFSET"} {
+		v, _ := env[key]
+		if v != "" {
+			return "", fmt.Errorf("%sPERCENTILE_COLUMN cannot be used with paginated metrics (%s%s)", gPrefix, gPrefix, key)
+		}
+	}
+	return col, nil
+}
+
+// pctOfTotalColumns returns value and percentage columns from V3_PCT_OF_TOTAL=value_col:pct_col
+// total is calculated over all rows, so it cannot be used with paginated metrics
+func pctOfTotalColumns(env map[string]string) (string, string, error) {
+	pctOfTotal, _ := env["PCT_OF_TOTAL"]
+	pctOfTotal = strings.TrimSpace(pctOfTotal)
+	if pctOfTotal == "" {
+		return "", "", nil
+	}
+	ary := strings.Split(pctOfTotal, ":")
+	if len(ary) != 2 || strings.TrimSpace(ary[0]) == "" || strings.TrimSpace(ary[1]) == "" {
+		return "", "", fmt.Errorf("%sPCT_OF_TOTAL must be in value_column:percent_column format, got: '%s'", gPrefix, pctOfTotal)
+	}
+	for _, key := range []string{"LIMIT", "OFFSET"} {
+		v, _ := env[key]
+		if v != "" {
+			return "", "", fmt.Errorf("%sPCT_OF_TOTAL cannot be used with paginated metrics (%s%s)", gPrefix, gPrefix, key)
+		}
+	}
+	return strings.TrimSpace(ary[0]), strings.TrimSpace(ary[1]), nil
+}
+
+// addPctOfTotal appends column idx value as a percentage (0-100) of that column total to every row
+// rows with null (or empty) values get null percentage and are not counted, all percentages are null when the total is 0
+func addPctOfTotal(rows [][]interface{}, idx int) error {
+	numbers := make([]float64, len(rows))
+	valid := make([]bool, len(rows))
+	total := 0.0
+	for r, row := range rows {
+		v := row[idx]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		if v == nil || v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(fmt.Sprintf("%v", v), 64)
+		if err != nil {
+			return fmt.Errorf("%sPCT_OF_TOTAL value '%v' is not numeric: %+v", gPrefix, v, err)
+		}
+		numbers[r], valid[r] = f, true
+		total += f
+	}
+	for r := range rows {
+		if !valid[r] || total == 0 {
+			rows[r] = append(rows[r], nil)
+			continue
+		}
+		rows[r] = append(rows[r], 100.0*numbers[r]/total)
+	}
+	return nil
+}
+
+func indexOf(ary []string, item string) int {
+	for i, v := range ary {
+		if v == item {
+			return i
+		}
+	}
+	return -1
+}
+
+// addPercentile appends percentile of column idx value to every row, it is the same as Postgres percent_rank() ordered by that column:
+// (number of rows with a lower value) / (number of rows - 1), rows with null (or empty) values get null percentile and are not counted
+func addPercentile(rows [][]interface{}, idx int) error {
+	numbers := make([]float64, len(rows))
+	valid := make([]bool, len(rows))
+	sorted := []float64{}
+	for r, row := range rows {
+		v := row[idx]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		if v == nil || v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(fmt.Sprintf("%v", v), 64)
+		if err != nil {
+			return fmt.Errorf("%sPERCENTILE_COLUMN value '%v' is not numeric: %+v", gPrefix, v, err)
+		}
+		numbers[r], valid[r] = f, true
+		sorted = append(sorted, f)
+	}
+	sort.Float64s(sorted)
+	n := len(sorted)
+	for r := range rows {
+		if !valid[r] {
+			rows[r] = append(rows[r], nil)
+			continue
+		}
+		pct := 0.0
+		if n > 1 {
+			lower := sort.SearchFloat64s(sorted, numbers[r])
+			pct = float64(lower) / float64(n-1)
+		}
+		rows[r] = append(rows[r], pct)
+	}
+	return nil
+}
+
+func calculate(db *sql.DB, sqlQuery, summaryQuery, table, projectSlug, timeRange, dtFrom, dtTo string, ppt, debug bool, env map[string]string) error {
+	dtStart := time.Now()
+	maxRows := 0
+	mr, ok := env["MAX_ROWS"]
+	if ok && mr != "" {
+		var err error
+		maxRows, err = strconv.Atoi(mr)
 		if err != nil {
 			return err
 		}
-		i++
-		args = append(args, []interface{}{timeRange, projectSlug, calcDt, dtFrom, dtTo, i}...)
-		for _, pValue := range pValues {
-			args = append(args, string(*pValue.(*sql.RawBytes)))
-		}
-		if ep == 0 {
-			ep = len(pValues)
-		}
-		if query == "" {
-			query = queryRoot
-			for j, colName := range colNames {
-				query += colName
-				if j < l {
-					query += ", "
-				}
-			}
-			query += fmt.Sprintf(`) values ($%d, $%d, $%d, $%d, $%d, $%d, `, p+1, p+2, p+3, p+4, p+5, p+6)
-		} else {
-			query += fmt.Sprintf(`, ($%d, $%d, $%d, $%d, $%d, $%d, `, p+1, p+2, p+3, p+4, p+5, p+6)
+		if debug {
+			lib.Logf("max rows limit: %d\n", maxRows)
 		}
-		for j := range colNames {
-			query += fmt.Sprintf("$%d", p+j+7)
-			if j < l {
-				query += ", "
-			}
+	}
+	percentileCol, err := percentileColumn(env)
+	if err != nil {
+		return err
+	}
+	totalValueCol, totalPctCol, err := pctOfTotalColumns(env)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := sourceConn(ctx, db, debug, env)
+	if err != nil {
+		return err
+	}
+	defer func() { releaseConn(ctx, conn, env) }()
+	_, useCopy := env["COPY"]
+	expectedRows := 0
+	_, countFirst := env["COUNT_FIRST"]
+	_, printDDL := env["PRINT_DDL"]
+	if countFirst && !printDDL {
+		expectedRows, err = countRows(ctx, conn, sqlQuery)
+		if err != nil {
+			return err
 		}
-		query += ")"
-		p += 6 + ep
-		if p >= gMaxPlaceholders-(6+ep) {
-			query += " on conflict(time_range, project_slug, date_from, date_to, row_number) do update set "
-			if l > 0 {
-				query += "("
-			}
-			for j, colName := range colNames {
-				query += colName
-				if j < l {
-					query += ", "
-				}
-			}
-			if l > 0 {
-				query += ") = ("
-			} else {
-				query += " = "
-			}
-			for j, colName := range colNames {
-				query += "excluded." + colName
-				if j < l {
-					query += ", "
-				}
-			}
-			if l > 0 {
-				query += ")"
-			}
-			if debug {
-				lib.Logf("flush at %d\n", p)
-				lib.Logf("query:\n%s\n", query)
-				lib.Logf("args(%d):\n%+v\n", len(args), args)
-			}
-			var rslt sql.Result
-			rslt, err = db.Exec(query, args...)
-			if err != nil {
-				lib.QueryOut(query, args...)
-				return err
-			}
-			nRows, err := rslt.RowsAffected()
+		lib.Logf("metric is expected to return %d rows\n", expectedRows)
+		copyThreshold := 100000
+		ct, _ := env["COPY_THRESHOLD"]
+		if ct != "" {
+			copyThreshold, err = strconv.Atoi(ct)
 			if err != nil {
-				lib.QueryOut(query, args...)
 				return err
 			}
-			if !changes && nRows > 0 {
-				changes = true
-			}
-			query = ""
-			args = []interface{}{}
-			p = 0
-			batches++
 		}
-	}
-	if len(args) > 0 {
-		query += " on conflict(time_range, project_slug, date_from, date_to, row_number) do update set "
-		if l > 0 {
-			query += "("
+		if !useCopy && expectedRows >= copyThreshold {
+			useCopy = true
+			lib.Logf("using COPY, expected rows %d >= %d threshold\n", expectedRows, copyThreshold)
 		}
-		for j, colName := range colNames {
-			query += colName
-			if j < l {
-				query += ", "
-			}
+	}
+	var (
+		rows      *sql.Rows
+		columns   []*sql.ColumnType
+		querySpan *span
+	)
+	if printDDL {
+		// only column types are needed, so no rows are materialized
+		columns, err = describeColumns(ctx, conn, sqlQuery)
+		if err != nil {
+			return err
 		}
-		if l > 0 {
-			query += ") = ("
-		} else {
-			query += " = "
+	} else {
+		querySpan = gTracer.start("query", map[string]interface{}{"table": table, "project_slug": projectSlug, "time_range": timeRange})
+		rows, err = conn.QueryContext(ctx, sqlQuery)
+		if err != nil {
+			lib.QueryOut(sqlQuery, []interface{}{}...)
+			return &lib.ErrQuery{Query: sqlQuery, Err: err}
 		}
-		for j, colName := range colNames {
-			query += "excluded." + colName
-			if j < l {
-				query += ", "
-			}
+		defer func() { _ = rows.Close() }()
+		columns, err = rows.ColumnTypes()
+		if err != nil {
+			return err
 		}
-		if l > 0 {
-			query += ")"
+	}
+	if debug {
+		lib.Logf("columns: %d\n", len(columns))
+		for _, column := range columns {
+			lib.Logf("%+v\n", column)
 		}
+	}
+	indicesAry := []string{}
+	indices, ok := env["INDEXED_COLUMNS"]
+	if ok && indices != "" {
+		indicesAry = strings.Split(indices, ",")
 		if debug {
-			lib.Logf("final flush at %d\n", p)
-			lib.Logf("query:\n%s\n", query)
-			lib.Logf("args(%d):\n%+v\n", len(args), args)
+			lib.Logf("extra indices requested: %+v\n", indicesAry)
 		}
-		var rslt sql.Result
-		rslt, err = db.Exec(query, args...)
+	}
+	keepHistory := 0
+	kh, ok := env["KEEP_HISTORY"]
+	if ok && kh != "" {
+		keepHistory, err = strconv.Atoi(kh)
 		if err != nil {
-			lib.QueryOut(query, args...)
 			return err
 		}
-		nRows, err := rslt.RowsAffected()
-		if err != nil {
-			lib.QueryOut(query, args...)
-			return err
+		if keepHistory <= 0 {
+			return fmt.Errorf("%sKEEP_HISTORY must be a positive number, got: %d", gPrefix, keepHistory)
 		}
-		if !changes && nRows > 0 {
-			changes = true
+	}
+	rnType, rnStart, err := rowNumberOptions(env)
+	if err != nil {
+		return err
+	}
+	// log-style tables get a generated id primary key and plain inserts
+	idCol := ""
+	_, surrogateKey := env["SURROGATE_KEY"]
+	if surrogateKey {
+		partitionBy, _ := env["PARTITION_BY"]
+		if partitionBy != "" {
+			return fmt.Errorf("%sSURROGATE_KEY cannot be used with %sPARTITION_BY, primary key of a partitioned table must include the partition key", gPrefix, gPrefix)
 		}
-		batches++
+		idCol = "  id bigserial primary key,\n"
 	}
-	err = rows.Err()
+	// Synthetic columns prepended to every row and key columns used for the primary key & conflict target
+	synthCols := "time_range, project_slug, last_calculated_at, date_from, date_to, row_number"
+	keyCols := "time_range, project_slug, date_from, date_to, row_number"
+	// unlogged tables skip WAL, so they are faster to write, but their data is lost after a crash
+	tableKind := "table"
+	_, unlogged := env["UNLOGGED"]
+	if unlogged {
+		partitionBy, _ := env["PARTITION_BY"]
+		if partitionBy != "" {
+			return fmt.Errorf("%sUNLOGGED cannot be used with %sPARTITION_BY, partitioned tables cannot be unlogged", gPrefix, gPrefix)
+		}
+		tableKind = "unlogged table"
+	}
+	createTable := fmt.Sprintf(`create %s if not exists "%s"(
+%s  time_range varchar(6) not null,
+  project_slug text not null,
+  last_calculated_at timestamp not null,
+  date_from date not null,
+  date_to date not null,
+  row_number %s not null,
+`,
+		tableKind,
+		table,
+		idCol,
+		rnType,
+	)
+	if keepHistory > 0 {
+		synthCols += ", snapshot_at"
+		keyCols += ", snapshot_at"
+		createTable += `  snapshot_at timestamp not null,
+`
+	}
+	// metric name allows multiple metrics to share a single table
+	metric, _ := env["METRIC"]
+	_, storeMetric := env["STORE_METRIC_NAME"]
+	if storeMetric {
+		synthCols += ", metric"
+		keyCols += ", metric"
+		createTable += `  metric text not null,
+`
+	}
+	// metric SQL fingerprint, tables created before enabling it get this column added
+	version, err := metricVersion(env)
 	if err != nil {
 		return err
 	}
-	if changes {
-		gFinalState = 1
+	if version != "" {
+		synthCols += ", metric_version"
+		createTable += `  metric_version text,
+`
 	}
-	lib.Logf("completed in %d batches\n", batches)
-	return nil
-}
-
-func currentTimeRange(timeRange string, debug bool, env map[string]string) (time.Time, time.Time) {
-	now := time.Now()
-	dtf, dtt := now, now
-	switch timeRange {
-	case "7d", "7dp":
-		_, daily := env["CALC_WEEK_DAILY"]
-		if daily {
-			dtt = lib.DayStart(now)
-			dtf = dtt.AddDate(0, 0, -7)
-		} else {
-			dtt = lib.WeekStart(now)
-			dtf = dtt.AddDate(0, 0, -7)
+	_, noPK := env["NO_PK"]
+	_, appendOnly := env["APPEND_ONLY"]
+	if noPK || appendOnly || surrogateKey {
+		// No primary key and plain inserts instead of UPSERT
+		keyCols = ""
+	}
+	conflictAction, _ := env["CONFLICT_ACTION"]
+	switch conflictAction {
+	case "":
+		conflictAction = "update"
+	case "update", "nothing":
+	default:
+		return fmt.Errorf("%sCONFLICT_ACTION must be one of: update, nothing, got: '%s'", gPrefix, conflictAction)
+	}
+	nSynth := len(strings.Split(synthCols, ","))
+	maxP, err := maxPlaceholders(env)
+	if err != nil {
+		return err
+	}
+	compressMap := make(map[string]struct{})
+	compressCols, _ := env["COMPRESS_COLUMNS"]
+	if compressCols != "" {
+		for _, colName := range strings.Split(compressCols, ",") {
+			compressMap[strings.TrimSpace(colName)] = struct{}{}
 		}
-		if timeRange == "7dp" {
-			dtf = dtf.AddDate(0, 0, -7)
-			dtt = dtt.AddDate(0, 0, -7)
+	}
+	partitionClause, partitionDDL, err := partitionSQL(table, timeRange, dtFrom, env)
+	if err != nil {
+		return err
+	}
+	notNullMap, nullableMap, err := nullabilityOverrides(env)
+	if err != nil {
+		return err
+	}
+	// V3_RECORD_EMPTY marker row (written when there is no V3_STATE_TABLE) has null metric columns
+	_, recordEmpty := env["RECORD_EMPTY"]
+	stateTable, _ := env["STATE_TABLE"]
+	emptyMarker := recordEmpty && stateTable == ""
+	if emptyMarker && len(notNullMap) > 0 {
+		return fmt.Errorf("%sNOT_NULL_COLUMNS cannot be used with %sRECORD_EMPTY (without %sSTATE_TABLE), empty result marker row has null metric columns", gPrefix, gPrefix, gPrefix)
+	}
+	l := len(columns) - 1
+	colNames := []string{}
+	colTypes := []string{}
+	namesMap := make(map[string]struct{})
+	compressed := make([]bool, len(columns))
+	for i, column := range columns {
+		colName, err := columnName(column.Name(), i+1, env)
+		if err != nil {
+			return err
 		}
-	case "30d", "30dp":
-		_, daily := env["CALC_MONTH_DAILY"]
-		if daily {
-			dtt = lib.DayStart(now)
-			dtf = dtt.AddDate(0, 0, -30)
-			if timeRange == "30dp" {
-				dtf = dtf.AddDate(0, 0, -30)
-				dtt = dtt.AddDate(0, 0, -30)
-			}
-		} else {
-			dtt = lib.MonthStart(now)
-			dtf = dtt.AddDate(0, -1, 0)
-			if timeRange == "30dp" {
-				dtf = dtf.AddDate(0, -1, 0)
-				dtt = dtt.AddDate(0, -1, 0)
-			}
+		tp, err := columnType(column, colName, env)
+		if err != nil {
+			return err
 		}
-	case "q", "qp":
-		_, daily := env["CALC_QUARTER_DAILY"]
-		if daily {
-			dtt = lib.DayStart(now)
-			dtf = dtt.AddDate(0, -3, 0)
-			if timeRange == "qp" {
-				dtf = dtf.AddDate(0, -3, 0)
-				dtt = dtt.AddDate(0, -3, 0)
-			}
-		} else {
-			dtt = lib.QuarterStart(now)
+		_, ok := namesMap[colName]
+		if ok {
+			return fmt.Errorf("non unique column name '%s'", colName)
+		}
+		if surrogateKey && colName == "id" {
+			return fmt.Errorf("metric SQL returns 'id' column, it cannot be used with %sSURROGATE_KEY", gPrefix)
+		}
+		namesMap[colName] = struct{}{}
+		colNames = append(colNames, colName)
+		_, compressed[i] = compressMap[colName]
+		if compressed[i] {
+			tp = "bytea"
+		}
+		colTypes = append(colTypes, tp)
+		createTable += fmt.Sprintf(`  %s %s`, colName, tp)
+		// driver nullability is unreliable for expressions, V3_NOT_NULL_COLUMNS and V3_NULLABLE_COLUMNS override it
+		nullable, ok := column.Nullable()
+		_, forceNotNull := notNullMap[colName]
+		_, forceNullable := nullableMap[colName]
+		if forceNotNull || (ok && !nullable && !forceNullable && !emptyMarker) {
+			createTable += ` not null`
+		}
+		if i == l && percentileCol != "" {
+			createTable += ",\n  percentile double precision"
+		}
+		if i == l && totalPctCol != "" {
+			createTable += fmt.Sprintf(",\n  %s double precision", totalPctCol)
+		}
+		if i < l {
+			createTable += ",\n"
+		} else if keyCols == "" {
+			createTable += fmt.Sprintf(`
+)%s;
+`,
+				partitionClause,
+			)
+		} else {
+			createTable += fmt.Sprintf(`,
+  primary key(%s)
+)%s;
+`,
+				keyCols,
+				partitionClause,
+			)
+		}
+	}
+	createTable += partitionDDL
+	pctIndex := -1
+	if percentileCol != "" {
+		pctIndex = indexOf(colNames, percentileCol)
+		if pctIndex < 0 {
+			return fmt.Errorf("column '%s' specified in %sPERCENTILE_COLUMN is not returned by the metric SQL", percentileCol, gPrefix)
+		}
+		_, ok := namesMap["percentile"]
+		if ok {
+			return fmt.Errorf("metric SQL already returns 'percentile' column, it cannot be used with %sPERCENTILE_COLUMN", gPrefix)
+		}
+		namesMap["percentile"] = struct{}{}
+		colNames = append(colNames, "percentile")
+		colTypes = append(colTypes, "double precision")
+	}
+	totalIndex := -1
+	if totalValueCol != "" {
+		totalIndex = indexOf(colNames, totalValueCol)
+		if totalIndex < 0 {
+			return fmt.Errorf("column '%s' specified in %sPCT_OF_TOTAL is not returned by the metric SQL", totalValueCol, gPrefix)
+		}
+		_, ok := namesMap[totalPctCol]
+		if ok {
+			return fmt.Errorf("metric SQL already returns '%s' column, it cannot be used as %sPCT_OF_TOTAL percent column", totalPctCol, gPrefix)
+		}
+		namesMap[totalPctCol] = struct{}{}
+		colNames = append(colNames, totalPctCol)
+		colTypes = append(colTypes, "double precision")
+	}
+	// computed columns are also bound, so they count towards the single row placeholders
+	if !useCopy && nSynth+len(colNames) > maxP {
+		return fmt.Errorf("table is too wide: %d metric columns + %d synthetic columns exceed the %d placeholders limit for a single row, consider using %sCOPY", len(colNames), nSynth, maxP, gPrefix)
+	}
+	for colName := range compressMap {
+		_, ok := namesMap[colName]
+		if !ok {
+			return fmt.Errorf("column '%s' specified in %sCOMPRESS_COLUMNS is not returned by the metric SQL", colName, gPrefix)
+		}
+		// computed columns are not scanned from the metric SQL, so they are never compressed
+		if (pctIndex >= 0 && colName == "percentile") || (totalIndex >= 0 && colName == totalPctCol) {
+			return fmt.Errorf("computed column '%s' cannot be specified in %sCOMPRESS_COLUMNS", colName, gPrefix)
+		}
+	}
+	// comments are re-applied on every run, so they stay in sync with the configuration
+	tableComment, _ := env["TABLE_COMMENT"]
+	schemaVer, err := schemaVersion(env)
+	if err != nil {
+		return err
+	}
+	if schemaVer > 0 {
+		tableComment = strings.TrimSpace(fmt.Sprintf("%s\nschema_version: %d", tableComment, schemaVer))
+	}
+	if tableComment != "" {
+		createTable += fmt.Sprintf(`comment on table "%s" is %s;
+`,
+			table,
+			pq.QuoteLiteral(tableComment),
+		)
+	}
+	for k := range env {
+		if strings.HasPrefix(k, "COLUMN_TYPE_") {
+			colName := k[12:]
+			_, ok := namesMap[colName]
+			if !ok {
+				return fmt.Errorf("column '%s' specified in %s%s is not returned by the metric SQL", colName, gPrefix, k)
+			}
+		}
+	}
+	for k, v := range env {
+		if strings.HasPrefix(k, "COLUMN_COMMENT_") {
+			colName := k[15:]
+			_, ok := namesMap[colName]
+			if !ok {
+				return fmt.Errorf("column '%s' specified in %s%s is not returned by the metric SQL", colName, gPrefix, k)
+			}
+			createTable += fmt.Sprintf(`comment on column "%s".%s is %s;
+`,
+				table,
+				colName,
+				pq.QuoteLiteral(v),
+			)
+		}
+	}
+	_, noTimeRangeIndex := env["NO_TIME_RANGE_INDEX"]
+	_, noProjectIndex := env["NO_PROJECT_INDEX"]
+	if !noTimeRangeIndex {
+		createTable += fmt.Sprintf(`create index if not exists "%s_time_range_idx" on "%s"(time_range);
+`,
+			table,
+			table,
+		)
+	}
+	if !ppt && !noProjectIndex {
+		createTable += fmt.Sprintf(`create index if not exists "%s_project_slug_idx" on "%s"(project_slug);
+`,
+			table,
+			table,
+		)
+	}
+	for _, index := range indicesAry {
+		createTable += fmt.Sprintf(`create index if not exists "%s_%s_idx" on "%s"(%s);
+`,
+			table,
+			index,
+			table,
+			index,
+		)
+	}
+	if version != "" {
+		createTable += fmt.Sprintf(`alter table "%s" add column if not exists metric_version text;
+`,
+			table,
+		)
+	}
+	for _, m := range []map[string]struct{}{notNullMap, nullableMap} {
+		for colName := range m {
+			_, ok := namesMap[colName]
+			if !ok {
+				return fmt.Errorf("column '%s' specified in %sNOT_NULL_COLUMNS or %sNULLABLE_COLUMNS is not returned by the metric SQL", colName, gPrefix, gPrefix)
+			}
+		}
+	}
+	// with V3_STATE_TABLE duration is recorded there
+	_, recordDuration := env["RECORD_DURATION"]
+	if recordDuration && stateTable == "" {
+		createTable += fmt.Sprintf(`alter table "%s" add column if not exists calc_duration_ms bigint;
+`,
+			table,
+		)
+	}
+	// immutable columns keep their originally inserted values
+	immutableMap := make(map[string]struct{})
+	immutableCols, _ := env["IMMUTABLE_COLUMNS"]
+	if immutableCols != "" {
+		for _, colName := range strings.Split(immutableCols, ",") {
+			colName = strings.TrimSpace(colName)
+			for _, keyCol := range strings.Split(keyCols, ",") {
+				if colName == strings.TrimSpace(keyCol) {
+					return fmt.Errorf("key column '%s' cannot be specified in %sIMMUTABLE_COLUMNS", colName, gPrefix)
+				}
+			}
+			_, ok := namesMap[colName]
+			if !ok {
+				return fmt.Errorf("column '%s' specified in %sIMMUTABLE_COLUMNS is not returned by the metric SQL", colName, gPrefix)
+			}
+			immutableMap[colName] = struct{}{}
+		}
+	}
+	updateCols := []string{}
+	if version != "" {
+		updateCols = append(updateCols, "metric_version")
+	}
+	for _, colName := range colNames {
+		_, immutable := immutableMap[colName]
+		if !immutable {
+			updateCols = append(updateCols, colName)
+		}
+	}
+	conflictWhere, err := conflictPredicate(table, synthCols, namesMap, env)
+	if err != nil {
+		return err
+	}
+	if conflictWhere != "" && (keyCols == "" || conflictAction == "nothing") {
+		return fmt.Errorf("%sCONFLICT_WHERE can only be used with on conflict update action", gPrefix)
+	}
+	merge, err := mergeExpressions(table, colNames, colTypes, immutableMap, env)
+	if err != nil {
+		return err
+	}
+	if len(merge) > 0 && (keyCols == "" || conflictAction == "nothing") {
+		return fmt.Errorf("%sMERGE_ columns can only be used with on conflict update action", gPrefix)
+	}
+	onConflict := conflictSQL(keyCols, conflictAction, conflictWhere, updateCols, merge)
+	_, latestView := env["CREATE_LATEST_VIEW"]
+	if latestView {
+		createTable += latestViewSQL(table, storeMetric)
+	}
+	if debug {
+		lib.Logf("create table:\n%s\n", createTable)
+	}
+	if printDDL {
+		fmt.Printf("%s", createTable)
+		setFinalState(lib.StateCalculated)
+		return nil
+	}
+	// All writes happen in a single transaction, so we can rollback when something goes wrong
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	writeSettings := []string{strings.Replace(gDateStyle, "set ", "set local ", 1)}
+	_, writesPath := env["SEARCH_PATH_WRITES"]
+	searchPath, _ := env["SEARCH_PATH"]
+	if writesPath && searchPath != "" {
+		writeSettings = append(writeSettings, "set local search_path to "+searchPath)
+	}
+	lockTimeout := lockTimeoutSQL(env)
+	if lockTimeout != "" {
+		writeSettings = append(writeSettings, lockTimeout)
+	}
+	for _, setting := range writeSettings {
+		_, err = tx.Exec(setting)
+		if err != nil {
+			lib.QueryOut(setting, []interface{}{}...)
+			return err
+		}
+	}
+	// with kafka only output there are no table writes (except V3_STATE_TABLE)
+	out, err := outputTargets(env)
+	if err != nil {
+		return err
+	}
+	toDB, toKafka := out.toDB, out.toKafka
+	if toDB && schemaVer > 0 {
+		synthTypes := synthColumnTypes(rnType)
+		tableCols := [][2]string{}
+		for _, colName := range strings.Split(synthCols, ", ") {
+			tableCols = append(tableCols, [2]string{colName, synthTypes[colName]})
+		}
+		for j, colName := range colNames {
+			tableCols = append(tableCols, [2]string{colName, colTypes[j]})
+		}
+		err = checkSchemaVersion(tx, table, schemaVer, keyCols, tableCols, debug, env)
+		if err != nil {
+			return err
+		}
+	}
+	if toDB {
+		_, err = tx.Exec(createTable)
+		if err != nil {
+			lib.QueryOut(createTable, []interface{}{}...)
+			logLockTimeout(err, env)
+			return &lib.ErrQuery{Query: createTable, Err: err}
+		}
+	}
+	var (
+		kafkaWriter *kafka.Writer
+		kafkaArgs   []interface{}
+		kafkaNames  []string
+	)
+	if toKafka {
+		kafkaWriter, err = newKafkaWriter(env)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = kafkaWriter.Close() }()
+		kafkaNames = append(strings.Split(synthCols, ", "), colNames...)
+	}
+	// parquet file is uploaded to S3 after all rows are fetched and written
+	var (
+		parquetOut *lib.ParquetWriter
+		parquetKey string
+	)
+	if out.toParquet {
+		parquetKey, err = s3Key(projectSlug, timeRange, dtFrom, dtTo, env)
+		if err != nil {
+			return err
+		}
+		synthTypes := synthColumnTypes(rnType)
+		pqColumns := []lib.ParquetColumn{}
+		for _, colName := range strings.Split(synthCols, ", ") {
+			pqColumns = append(pqColumns, lib.ParquetColumn{Name: colName, Type: synthTypes[colName]})
+		}
+		for j, colName := range colNames {
+			pqColumns = append(pqColumns, lib.ParquetColumn{Name: colName, Type: colTypes[j]})
+		}
+		parquetOut = lib.NewParquetWriter(pqColumns)
+	}
+	var jsonNames, jsonTypes []string
+	if out.toJSON {
+		jsonNames = append(strings.Split(synthCols, ", "), colNames...)
+		dbTypes := []string{}
+		for _, column := range columns {
+			dbTypes = append(dbTypes, strings.ToLower(column.DatabaseTypeName()))
+		}
+		jsonTypes = jsonColumnTypes(nSynth, dbTypes, pctIndex >= 0, totalIndex >= 0)
+	}
+	i := 0
+	nColumns := len(colNames)
+	ep := nSynth + nColumns
+	_, typed := env["TYPED_SCAN"]
+	pValues := make([]interface{}, len(columns))
+	for i, column := range columns {
+		pValues[i] = newScanDest(column, typed, compressed[i])
+	}
+	calcDt := time.Now()
+	if debug {
+		lib.Logf("calculation timestamp: %s\n", lib.ToYMDHMSf(calcDt, 6))
+	}
+	var diff *rowsDiff
+	_, diffMode := env["DIFF"]
+	if diffMode {
+		diff, err = newRowsDiff(tx, table, colNames, keepHistory > 0, timeRange, projectSlug, dtFrom, dtTo, env)
+		if err != nil {
+			return err
+		}
+	}
+	// rows progress is reported on flushes, by default at most every 10 seconds
+	pr, err := newProgress("rows", expectedRows, 10*time.Second, env)
+	if err != nil {
+		return err
+	}
+	// with COPY rows are copied into a temporary table and then upserted from it using a single statement
+	var copyStmt *sql.Stmt
+	if useCopy && toDB {
+		copyStmt, err = copyTable(tx, table, strings.Split(synthCols, ", "), colNames, debug)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = copyStmt.Close() }()
+	}
+	// p - placeholders used by the current batch, ep - placeholders used by a single row
+	p := 0
+	changes := false
+	affected := int64(0)
+	args := []interface{}{}
+	batches := 0
+	next := func() ([]interface{}, bool, error) {
+		if !rows.Next() {
+			return nil, false, nil
+		}
+		err := rows.Scan(pValues...)
+		if err != nil {
+			return nil, false, err
+		}
+		values := make([]interface{}, 0, nColumns)
+		for j, pValue := range pValues {
+			value, err := scannedValue(pValue, compressed[j])
+			if err != nil {
+				return nil, false, err
+			}
+			values = append(values, value)
+		}
+		return values, true, nil
+	}
+	// percentile and percentage of total need all rows, so they are fetched before anything is written
+	if pctIndex >= 0 || totalIndex >= 0 {
+		all := [][]interface{}{}
+		for {
+			values, ok, err := next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if maxRows > 0 && len(all) >= maxRows {
+				return fmt.Errorf("metric returned more than %d rows (%sMAX_ROWS), rolling back", maxRows, gPrefix)
+			}
+			all = append(all, values)
+		}
+		if pctIndex >= 0 {
+			err = addPercentile(all, pctIndex)
+			if err != nil {
+				return err
+			}
+		}
+		if totalIndex >= 0 {
+			err = addPctOfTotal(all, totalIndex)
+			if err != nil {
+				return err
+			}
+		}
+		k := 0
+		next = func() ([]interface{}, bool, error) {
+			if k >= len(all) {
+				return nil, false, nil
+			}
+			k++
+			return all[k-1], true, nil
+		}
+	}
+	for {
+		values, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		i++
+		if maxRows > 0 && i > maxRows {
+			return fmt.Errorf("metric returned more than %d rows (%sMAX_ROWS), rolling back", maxRows, gPrefix)
+		}
+		rowNumber := i - 1 + rnStart
+		args = append(args, []interface{}{timeRange, projectSlug, calcDt, dtFrom, dtTo, rowNumber}...)
+		if keepHistory > 0 {
+			args = append(args, calcDt)
+		}
+		if storeMetric {
+			args = append(args, metric)
+		}
+		if version != "" {
+			args = append(args, version)
+		}
+		args = append(args, values...)
+		if diff != nil {
+			diff.compare(rowNumber, args[len(args)-nColumns:])
+		}
+		if out.toJSON {
+			err = gJSONOut.write(jsonNames, jsonTypes, args[len(args)-ep:])
+			if err != nil {
+				return err
+			}
+		}
+		if parquetOut != nil {
+			err = parquetOut.Write(args[len(args)-ep:])
+			if err != nil {
+				return err
+			}
+		}
+		// rows are produced to kafka only after the transaction is committed
+		if kafkaWriter != nil {
+			kafkaArgs = append(kafkaArgs, args[len(args)-ep:]...)
+		}
+		if !toDB {
+			args = []interface{}{}
+			pr.step(1)
+			continue
+		}
+		if copyStmt != nil {
+			_, err = copyStmt.Exec(args...)
+			if err != nil {
+				return err
+			}
+			args = []interface{}{}
+			pr.step(1)
+			continue
+		}
+		p += ep
+		// flush when the next row would not fit, so a batch never exceeds maxP placeholders
+		if p+ep > maxP {
+			if debug {
+				lib.Logf("flush at %d\n", p)
+			}
+			nRows, err := flushBatch(tx, table, synthCols, onConflict, nSynth, colNames, args, debug)
+			if err != nil {
+				return conflictDiagnostic(err, table, keyCols)
+			}
+			if !changes && nRows > 0 {
+				changes = true
+			}
+			affected += nRows
+			pr.step(len(args) / ep)
+			args = []interface{}{}
+			p = 0
+			batches++
+		}
+	}
+	if copyStmt != nil {
+		nRows, err := copyFinish(tx, copyStmt, table, synthCols, onConflict, colNames, debug)
+		if err != nil {
+			return conflictDiagnostic(err, table, keyCols)
+		}
+		changes = nRows > 0
+		affected = nRows
+		batches++
+	}
+	if len(args) > 0 {
+		if debug {
+			lib.Logf("final flush at %d\n", p)
+		}
+		nRows, err := flushBatch(tx, table, synthCols, onConflict, nSynth, colNames, args, debug)
+		if err != nil {
+			return conflictDiagnostic(err, table, keyCols)
+		}
+		if !changes && nRows > 0 {
+			changes = true
+		}
+		affected += nRows
+		batches++
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	querySpan.finish(map[string]interface{}{"rows": i, "batches": batches})
+	if kafkaWriter != nil && i > 0 {
+		changes = true
+	}
+	if out.toJSON {
+		lib.Logf("written %d JSON rows\n", i)
+		if i > 0 {
+			changes = true
+		}
+	}
+	if parquetOut != nil && i > 0 {
+		changes = true
+	}
+	if diff != nil {
+		diff.finish()
+	}
+	// with "do nothing" rows already present are not affected, this is expected
+	if onConflict != "" && conflictAction == "nothing" && affected < int64(i) {
+		lib.Logf("%d rows skipped due to conflicts with already existing rows\n", int64(i)-affected)
+	}
+	synthValues := func(rowNumber int) []interface{} {
+		values := []interface{}{timeRange, projectSlug, calcDt, dtFrom, dtTo, rowNumber}
+		if keepHistory > 0 {
+			values = append(values, calcDt)
+		}
+		if storeMetric {
+			values = append(values, metric)
+		}
+		if version != "" {
+			values = append(values, version)
+		}
+		return values
+	}
+	if summaryQuery != "" && toDB {
+		summary, err := storeSummary(ctx, conn, tx, summaryQuery, table, synthCols, keyCols, conflictAction, synthValues(0), namesMap, compressMap, immutableMap, version != "", debug)
+		if err != nil {
+			return err
+		}
+		if summary {
+			changes = true
+		}
+	}
+	// empty result is recorded, so it is not recalculated on every run (V3_RECORD_EMPTY)
+	if recordEmpty && i == 0 && !changes && toDB {
+		if stateTable == "" {
+			err = storeEmptyMarker(tx, table, synthCols, keyCols, synthValues(-1), debug)
+			if err != nil {
+				return err
+			}
+		}
+		lib.Logf("metric SQL returned no rows, recording empty result\n")
+		changes = true
+	}
+	if keepHistory > 0 && toDB {
+		err = pruneHistory(tx, table, timeRange, projectSlug, dtFrom, dtTo, keepHistory, debug, env)
+		if err != nil {
+			return err
+		}
+	}
+	duration := time.Since(dtStart)
+	if recordDuration && stateTable == "" && toDB {
+		err = storeDuration(tx, table, timeRange, projectSlug, dtFrom, dtTo, calcDt, duration, keepHistory > 0, debug, env)
+		if err != nil {
+			return err
+		}
+	}
+	err = storeState(tx, timeRange, projectSlug, dtFrom, dtTo, calcDt, duration, debug, env)
+	if err != nil {
+		return err
+	}
+	err = storeRowCount(tx, timeRange, projectSlug, dtFrom, dtTo, calcDt, i, debug, env)
+	if err != nil {
+		return err
+	}
+	// unexpected rows count rolls back all writes, unless V3_EXPECT_KEEP is set - then data is kept but the run still fails
+	expectErr := checkExpectedRows(i, env)
+	_, expectKeep := env["EXPECT_KEEP"]
+	if expectErr != nil && !expectKeep {
+		return fmt.Errorf("%+v, rolling back", expectErr)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	committed = true
+	if expectErr != nil {
+		return expectErr
+	}
+	// kafka batches have the same size as UPSERT batches
+	if kafkaWriter != nil {
+		batchSize := (maxP / ep) * ep
+		for start := 0; start < len(kafkaArgs); start += batchSize {
+			end := start + batchSize
+			if end > len(kafkaArgs) {
+				end = len(kafkaArgs)
+			}
+			err = produceRows(kafkaWriter, kafkaNames, kafkaArgs[start:end], debug)
+			if err != nil {
+				return err
+			}
+		}
+		lib.Logf("produced %d rows to kafka\n", i)
+	}
+	// parquet file is uploaded only after the transaction is committed
+	if parquetOut != nil && i > 0 {
+		var buf bytes.Buffer
+		_, err = parquetOut.WriteTo(&buf)
+		if err != nil {
+			return err
+		}
+		err = s3Put(parquetKey, buf.Bytes(), "application/vnd.apache.parquet", env)
+		if err != nil {
+			return err
+		}
+		bucket, _ := env["S3_BUCKET"]
+		lib.Logf("uploaded %d rows (%d bytes) to s3://%s/%s\n", i, buf.Len(), bucket, parquetKey)
+	}
+	if changes {
+		setFinalState(lib.StateCalculated)
+	}
+	lib.Logf("completed in %d batches\n", batches)
+	return nil
+}
+
+// rowsDiff compares calculated rows with rows currently stored for the same key (V3_DIFF mode)
+type rowsDiff struct {
+	colNames []string
+	current  map[int][]string
+	max      int
+	logged   int
+	added    int
+	changed  int
+	removed  int
+}
+
+// newRowsDiff reads rows currently stored for a given calculation key (latest snapshot in history mode)
+func newRowsDiff(tx *sql.Tx, table string, colNames []string, history bool, timeRange, projectSlug, dtFrom, dtTo string, env map[string]string) (*rowsDiff, error) {
+	diff := &rowsDiff{colNames: colNames, current: make(map[int][]string), max: 100}
+	dm, _ := env["DIFF_MAX"]
+	if dm != "" {
+		var err error
+		diff.max, err = strconv.Atoi(dm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// skip summary (0) and empty marker (-1) rows
+	_, rnStart, err := rowNumberOptions(env)
+	if err != nil {
+		return nil, err
+	}
+	mCond, mArgs := metricCond(5, env)
+	query := fmt.Sprintf(
+		`select row_number, %s from "%s" where time_range = $1 and project_slug = $2 and date_from = $3 and date_to = $4 and row_number >= %d%s`,
+		strings.Join(colNames, ", "),
+		table,
+		rnStart,
+		mCond,
+	)
+	if history {
+		// later snapshots overwrite earlier ones
+		query += " order by snapshot_at"
+	}
+	args := append([]interface{}{timeRange, projectSlug, dtFrom, dtTo}, mArgs...)
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		lib.QueryOut(query, args...)
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	rowNumber := 0
+	values := make([]sql.NullString, len(colNames))
+	pValues := []interface{}{&rowNumber}
+	for i := range values {
+		pValues = append(pValues, &values[i])
+	}
+	for rows.Next() {
+		err = rows.Scan(pValues...)
+		if err != nil {
+			return nil, err
+		}
+		row := make([]string, len(colNames))
+		for i, value := range values {
+			row[i] = "null"
+			if value.Valid {
+				row[i] = value.String
+			}
+		}
+		diff.current[rowNumber] = row
+	}
+	return diff, rows.Err()
+}
+
+// diffValue returns text representation of a value to bind, matching how stored values are read back
+func diffValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func (d *rowsDiff) log(format string, args ...interface{}) {
+	if d.logged < d.max {
+		lib.Logf(format, args...)
+	}
+	d.logged++
+}
+
+// compare compares a calculated row with the currently stored row having the same row_number
+func (d *rowsDiff) compare(rowNumber int, values []interface{}) {
+	current, ok := d.current[rowNumber]
+	if !ok {
+		d.added++
+		d.log("diff: row %d added\n", rowNumber)
+		return
+	}
+	delete(d.current, rowNumber)
+	changes := []string{}
+	for i, value := range values {
+		newValue := diffValue(value)
+		if newValue != current[i] {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", d.colNames[i], current[i], newValue))
+		}
+	}
+	if len(changes) > 0 {
+		d.changed++
+		d.log("diff: row %d changed: %s\n", rowNumber, strings.Join(changes, ", "))
+	}
+}
+
+// finish reports rows that are no longer returned by the metric and logs summary
+func (d *rowsDiff) finish() {
+	for rowNumber := range d.current {
+		d.removed++
+		d.log("diff: row %d removed\n", rowNumber)
+	}
+	if d.logged > d.max {
+		lib.Logf("diff: %d more differences not shown (%sDIFF_MAX=%d)\n", d.logged-d.max, gPrefix, d.max)
+	}
+	lib.Logf("diff: %d added, %d changed, %d removed\n", d.added, d.changed, d.removed)
+}
+
+// describeColumns returns column types of the metric SQL without materializing its rows (limit 0)
+func describeColumns(ctx context.Context, conn *sql.Conn, sqlQuery string) ([]*sql.ColumnType, error) {
+	query := fmt.Sprintf("select * from (\n%s\n) t limit 0", trimSQL(sqlQuery))
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		lib.QueryOut(query, []interface{}{}...)
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	return rows.ColumnTypes()
+}
+
+// countRows returns number of rows that the metric SQL returns (V3_COUNT_FIRST preflight)
+func countRows(ctx context.Context, conn *sql.Conn, sqlQuery string) (int, error) {
+	query := fmt.Sprintf("select count(*) from (\n%s\n) t", trimSQL(sqlQuery))
+	count := 0
+	err := conn.QueryRowContext(ctx, query).Scan(&count)
+	if err != nil {
+		lib.QueryOut(query, []interface{}{}...)
+		return 0, err
+	}
+	return count, nil
+}
+
+// gCopyTable is a temporary table used to COPY rows into, it is dropped on commit
+const gCopyTable = "calcmetric_copy"
+
+// copyTable creates a temporary table with synthetic and metric columns of table and returns COPY statement for it
+// other columns (like V3_SURROGATE_KEY id) are not copied, so their defaults are applied by the final insert
+func copyTable(tx *sql.Tx, table string, synthCols, colNames []string, debug bool) (*sql.Stmt, error) {
+	cols := append(append([]string{}, synthCols...), colNames...)
+	query := fmt.Sprintf(`create temp table "%s" on commit drop as select %s from "%s" with no data`, gCopyTable, strings.Join(cols, ", "), table)
+	if debug {
+		lib.Logf("copy table:\n%s\n", query)
+	}
+	_, err := tx.Exec(query)
+	if err != nil {
+		lib.QueryOut(query, []interface{}{}...)
+		return nil, err
+	}
+	return tx.Prepare(pq.CopyIn(gCopyTable, cols...))
+}
+
+// copyFinish flushes COPY data and upserts copied rows into the target table, returns number of affected rows
+func copyFinish(tx *sql.Tx, copyStmt *sql.Stmt, table, synthCols, onConflict string, colNames []string, debug bool) (int64, error) {
+	_, err := copyStmt.Exec()
+	if err != nil {
+		return 0, err
+	}
+	cols := synthCols + ", " + strings.Join(colNames, ", ")
+	query := fmt.Sprintf(`insert into "%s"(%s) select %s from "%s"%s`, table, cols, cols, gCopyTable, onConflict)
+	if debug {
+		lib.Logf("copy query:\n%s\n", query)
+	}
+	rslt, err := tx.Exec(query)
+	if err != nil {
+		lib.QueryOut(query, []interface{}{}...)
+		return 0, &lib.ErrQuery{Query: query, Err: err}
+	}
+	return rslt.RowsAffected()
+}
+
+// conflictDiagnostic explains unique_violation errors returned while writing rows, other errors are returned as is
+// it happens when the table's unique constraints differ from the conflict target used (or rows are plain inserted)
+func conflictDiagnostic(err error, table, keyCols string) error {
+	var e *pq.Error
+	if !errors.As(err, &e) || e.Code.Name() != "unique_violation" {
+		return err
+	}
+	target := "none, rows are plain inserted (" + gPrefix + "APPEND_ONLY, " + gPrefix + "NO_PK or " + gPrefix + "SURROGATE_KEY)"
+	if keyCols != "" {
+		target = "(" + keyCols + ")"
+	}
+	return fmt.Errorf(
+		"duplicate key in table '%s' violates unique constraint '%s' (%s), but the conflict target is %s, "+
+			"the table was probably created with different key columns (for example before setting %sKEEP_HISTORY, %sSTORE_METRIC_NAME or %sAPPEND_ONLY) "+
+			"or it has an additional unique index, use %sDROP to recreate it: %+v",
+		table, e.Constraint, strings.TrimSpace(e.Detail), target, gPrefix, gPrefix, gPrefix, gPrefix, err,
+	)
+}
+
+// conflictSQL returns the on conflict clause for a given conflict target and action (update or nothing)
+// colNames are columns to update, when there are none this is the same as nothing action
+// where is an optional predicate limiting which conflicting rows are updated
+// merge maps columns to their update expressions (see mergeExpressions), other columns are overwritten
+// When keyCols is empty this returns an empty string - plain insert (append only mode)
+func conflictSQL(keyCols, action, where string, colNames []string, merge map[string]string) string {
+	if keyCols == "" {
+		return ""
+	}
+	if action == "nothing" || len(colNames) == 0 {
+		return " on conflict(" + keyCols + ") do nothing"
+	}
+	excluded := make([]string, len(colNames))
+	for j, colName := range colNames {
+		excluded[j] = "excluded." + colName
+	}
+	if where != "" {
+		where = " where " + where
+	}
+	if len(merge) > 0 {
+		sets := make([]string, len(colNames))
+		for j, colName := range colNames {
+			expr, ok := merge[colName]
+			if !ok {
+				expr = excluded[j]
+			}
+			sets[j] = colName + " = " + expr
+		}
+		return " on conflict(" + keyCols + ") do update set " + strings.Join(sets, ", ") + where
+	}
+	if len(colNames) > 1 {
+		return " on conflict(" + keyCols + ") do update set (" + strings.Join(colNames, ", ") + ") = (" + strings.Join(excluded, ", ") + ")" + where
+	}
+	return " on conflict(" + keyCols + ") do update set " + colNames[0] + " = " + excluded[0] + where
+}
+
+// mergeExpressions returns on conflict update expressions of columns with V3_MERGE_<column>=sum|max|min|overwrite
+// sum, max and min can only be used for numeric columns, nulls are ignored (like greatest and least do)
+func mergeExpressions(table string, colNames, colTypes []string, immutableMap map[string]struct{}, env map[string]string) (map[string]string, error) {
+	merge := make(map[string]string)
+	for k, strategy := range env {
+		if !strings.HasPrefix(k, "MERGE_") {
+			continue
+		}
+		colName := k[6:]
+		idx := indexOf(colNames, colName)
+		if idx < 0 {
+			return nil, fmt.Errorf("column '%s' specified in %s%s is not returned by the metric SQL", colName, gPrefix, k)
+		}
+		_, immutable := immutableMap[colName]
+		if immutable {
+			return nil, fmt.Errorf("column '%s' cannot be specified in both %sIMMUTABLE_COLUMNS and %s%s", colName, gPrefix, gPrefix, k)
+		}
+		current := fmt.Sprintf(`"%s".%s`, table, colName)
+		excluded := "excluded." + colName
+		switch strategy {
+		case "overwrite":
+			continue
+		case "sum":
+			merge[colName] = fmt.Sprintf("coalesce(%s + %s, %s, %s)", current, excluded, current, excluded)
+		case "max":
+			merge[colName] = fmt.Sprintf("greatest(%s, %s)", current, excluded)
+		case "min":
+			merge[colName] = fmt.Sprintf("least(%s, %s)", current, excluded)
+		default:
+			return nil, fmt.Errorf("%s%s must be one of: sum, max, min, overwrite, got: '%s'", gPrefix, k, strategy)
+		}
+		if !gNumericTypeRe.MatchString(colTypes[idx]) {
+			return nil, fmt.Errorf("%s%s=%s requires a numeric column, '%s' is %s", gPrefix, k, strategy, colName, colTypes[idx])
+		}
+	}
+	return merge, nil
+}
+
+// conflictPredicate returns V3_CONFLICT_WHERE predicate with {{table}} replaced by the quoted table name
+// existing row columns are referenced as {{table}}.column, incoming row columns as excluded.column
+// all qualified column references must use one of those and name an existing column
+func conflictPredicate(table, synthCols string, namesMap map[string]struct{}, env map[string]string) (string, error) {
+	where, _ := env["CONFLICT_WHERE"]
+	where = strings.TrimSpace(where)
+	if where == "" {
+		return "", nil
+	}
+	quoted := `"` + table + `"`
+	where = strings.Replace(where, "{{table}}", quoted, -1)
+	columns := make(map[string]struct{})
+	for _, colName := range strings.Split(synthCols, ",") {
+		columns[strings.TrimSpace(colName)] = struct{}{}
+	}
+	columns["metric_version"] = struct{}{}
+	for colName := range namesMap {
+		columns[colName] = struct{}{}
+	}
+	// string literals can contain anything, including dots
+	stripped := gSQLStringRe.ReplaceAllString(where, "''")
+	for _, m := range gQualifiedColumnRe.FindAllStringSubmatch(stripped, -1) {
+		if strings.HasSuffix(m[0], "(") {
+			// schema qualified function call
+			continue
+		}
+		if m[1] != "excluded" && m[1] != quoted {
+			return "", fmt.Errorf("%sCONFLICT_WHERE: unknown reference '%s', use excluded.column or {{table}}.column", gPrefix, strings.TrimSpace(m[0]))
+		}
+		_, ok := columns[strings.Trim(m[2], `"`)]
+		if !ok {
+			return "", fmt.Errorf("%sCONFLICT_WHERE: column '%s' doesn't exist in '%s'", gPrefix, m[2], table)
+		}
+	}
+	return where, nil
+}
+
+// partitionSQL returns partitioning clause for create table and DDL creating partition for the current calculation
+// V3_PARTITION_BY can be: time_range (list partition per time range) or date_from (range partition per year)
+func partitionSQL(table, timeRange, dtFrom string, env map[string]string) (string, string, error) {
+	partitionBy, _ := env["PARTITION_BY"]
+	switch partitionBy {
+	case "":
+		return "", "", nil
+	case "time_range":
+		return " partition by list(time_range)", fmt.Sprintf(`create table if not exists "%s_%s" partition of "%s" for values in (%s);
+`,
+			table,
+			toDBIdentifier(timeRange),
+			table,
+			pq.QuoteLiteral(timeRange),
+		), nil
+	case "date_from":
+		dtf, err := lib.TimeParseAny(dtFrom)
+		if err != nil {
+			return "", "", err
+		}
+		year := dtf.Year()
+		return " partition by range(date_from)", fmt.Sprintf(`create table if not exists "%s_y%d" partition of "%s" for values from ('%04d-01-01') to ('%04d-01-01');
+`,
+			table,
+			year,
+			table,
+			year,
+			year+1,
+		), nil
+	default:
+		return "", "", fmt.Errorf("unknown %sPARTITION_BY: '%s', allowed values are: time_range, date_from", gPrefix, partitionBy)
+	}
+}
+
+// schemaVersion returns V3_SCHEMA_VERSION (positive integer) or 0 when not set
+func schemaVersion(env map[string]string) (int, error) {
+	sv, _ := env["SCHEMA_VERSION"]
+	if sv == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(sv)
+	if err != nil {
+		return 0, err
+	}
+	if version <= 0 {
+		return 0, fmt.Errorf("%sSCHEMA_VERSION must be a positive number, got: %d", gPrefix, version)
+	}
+	return version, nil
+}
+
+// synthColumnTypes returns types of synthetic columns
+func synthColumnTypes(rnType string) map[string]string {
+	return map[string]string{
+		"time_range":         "varchar(6)",
+		"project_slug":       "text",
+		"last_calculated_at": "timestamp",
+		"date_from":          "date",
+		"date_to":            "date",
+		"row_number":         rnType,
+		"snapshot_at":        "timestamp",
+		"metric":             "text",
+		"metric_version":     "text",
+	}
+}
+
+// checkSchemaVersion compares schema version stored in the existing table comment with V3_SCHEMA_VERSION
+// tables without the version are treated as version 0, older tables are only accepted with V3_AUTO_MIGRATE
+// (missing columns are added by migrateTable, then table comment is updated to the current version by the create table DDL)
+// columns are (name, type) pairs of all synthetic and metric columns of the current table definition
+func checkSchemaVersion(tx *sql.Tx, table string, version int, keyCols string, columns [][2]string, debug bool, env map[string]string) error {
+	var comment sql.NullString
+	exists := false
+	query := `select true, obj_description(to_regclass($1), 'pg_class') where to_regclass($1) is not null`
+	err := tx.QueryRow(query, `"`+table+`"`).Scan(&exists, &comment)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		lib.QueryOut(query, table)
+		return err
+	}
+	current := 0
+	m := gSchemaVersionRe.FindStringSubmatch(comment.String)
+	if len(m) > 1 {
+		current, _ = strconv.Atoi(m[1])
+	}
+	if current == version {
+		return nil
+	}
+	if current > version {
+		return &lib.ErrSchemaMismatch{
+			Table: table,
+			Msg:   fmt.Sprintf("table '%s' has schema version %d, newer than %sSCHEMA_VERSION=%d", table, current, gPrefix, version),
+		}
+	}
+	_, autoMigrate := env["AUTO_MIGRATE"]
+	if !autoMigrate {
+		return &lib.ErrSchemaMismatch{
+			Table: table,
+			Msg:   fmt.Sprintf("table '%s' has schema version %d, incompatible with %sSCHEMA_VERSION=%d, migrate it or set %sAUTO_MIGRATE", table, current, gPrefix, version, gPrefix),
+		}
+	}
+	lib.Logf("table '%s' schema version %d will be migrated to %d\n", table, current, version)
+	return migrateTable(tx, table, keyCols, columns, debug)
+}
+
+// migrateTable adds columns missing in an existing table (V3_AUTO_MIGRATE), they are added as nullable, because existing rows
+// have no values for them, missing key columns would change the primary key, so they cannot be migrated
+func migrateTable(tx *sql.Tx, table, keyCols string, columns [][2]string, debug bool) error {
+	query := `select attname from pg_attribute where attrelid = to_regclass($1) and attnum > 0 and not attisdropped`
+	rows, err := tx.Query(query, `"`+table+`"`)
+	if err != nil {
+		lib.QueryOut(query, table)
+		return err
+	}
+	existing := make(map[string]struct{})
+	for rows.Next() {
+		var colName string
+		err = rows.Scan(&colName)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		existing[colName] = struct{}{}
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return err
+	}
+	keyMap := make(map[string]struct{})
+	for _, keyCol := range strings.Split(keyCols, ",") {
+		keyMap[strings.TrimSpace(keyCol)] = struct{}{}
+	}
+	for _, column := range columns {
+		_, ok := existing[column[0]]
+		if ok {
+			continue
+		}
+		_, key := keyMap[column[0]]
+		if key {
+			return &lib.ErrSchemaMismatch{
+				Table: table,
+				Msg:   fmt.Sprintf("table '%s' is missing key column '%s', it cannot be migrated automatically, migrate it manually or use %sDROP", table, column[0], gPrefix),
+			}
+		}
+		alter := fmt.Sprintf(`alter table "%s" add column if not exists %s %s`, table, column[0], column[1])
+		if debug {
+			lib.Logf("migrate table:\n%s\n", alter)
+		}
+		_, err = tx.Exec(alter)
+		if err != nil {
+			lib.QueryOut(alter, []interface{}{}...)
+			return &lib.ErrQuery{Query: alter, Err: err}
+		}
+		lib.Logf("table '%s' migrated: added column %s %s\n", table, column[0], column[1])
+	}
+	return nil
+}
+
+// latestViewSQL returns DDL (re)creating "<table>_latest" view (V3_CREATE_LATEST_VIEW) with rows of the most recent
+// calculation of each time range and project (and metric), regardless of the date window
+// view is recreated on every run, so it always has the current table columns
+func latestViewSQL(table string, storeMetric bool) string {
+	keyCols := "time_range, project_slug"
+	if storeMetric {
+		keyCols += ", metric"
+	}
+	return fmt.Sprintf(`drop view if exists "%s_latest";
+create view "%s_latest" as select * from "%s" where (%s, last_calculated_at) in (select %s, max(last_calculated_at) from "%s" group by %s);
+`,
+		table,
+		table,
+		table,
+		keyCols,
+		keyCols,
+		table,
+		keyCols,
+	)
+}
+
+// storeRowCount appends number of rows returned by the metric SQL to V3_COUNT_TABLE (if set)
+// each calculation adds a new row, so the table holds history of metric sizes
+func storeRowCount(tx *sql.Tx, timeRange, projectSlug, dtFrom, dtTo string, calcDt time.Time, rowCount int, debug bool, env map[string]string) error {
+	countTable, _ := env["COUNT_TABLE"]
+	if countTable == "" {
+		return nil
+	}
+	metric, _ := env["METRIC"]
+	createTable := fmt.Sprintf(`create table if not exists "%s"(
+  metric text not null,
+  project_slug text not null,
+  time_range varchar(6) not null,
+  date_from date not null,
+  date_to date not null,
+  row_count bigint not null,
+  calculated_at timestamp not null
+);
+create index if not exists "%s_key_idx" on "%s"(metric, project_slug, time_range, calculated_at)`,
+		countTable,
+		countTable,
+		countTable,
+	)
+	query := fmt.Sprintf(
+		`insert into "%s"(metric, project_slug, time_range, date_from, date_to, row_count, calculated_at) values ($1, $2, $3, $4, $5, $6, $7)`,
+		countTable,
+	)
+	args := []interface{}{metric, projectSlug, timeRange, dtFrom, dtTo, rowCount, calcDt}
+	if debug {
+		lib.Logf("count table:\n%s\n%s\n%+v\n", createTable, query, args)
+	}
+	_, err := tx.Exec(createTable)
+	if err != nil {
+		lib.QueryOut(createTable, []interface{}{}...)
+		return err
+	}
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		lib.QueryOut(query, args...)
+		return err
+	}
+	return nil
+}
+
+// storeDuration sets calc_duration_ms of all rows of the current calculation (V3_RECORD_DURATION without V3_STATE_TABLE)
+func storeDuration(tx *sql.Tx, table, timeRange, projectSlug, dtFrom, dtTo string, calcDt time.Time, duration time.Duration, history, debug bool, env map[string]string) error {
+	args := []interface{}{duration.Milliseconds(), timeRange, projectSlug, dtFrom, dtTo}
+	cond := ""
+	if history {
+		cond = " and snapshot_at = $6"
+		args = append(args, calcDt)
+	}
+	mCond, mArgs := metricCond(len(args)+1, env)
+	args = append(args, mArgs...)
+	query := fmt.Sprintf(
+		`update "%s" set calc_duration_ms = $1 where time_range = $2 and project_slug = $3 and date_from = $4 and date_to = $5%s%s`,
+		table,
+		cond,
+		mCond,
+	)
+	if debug {
+		lib.Logf("store duration:\n%s\n%+v\n", query, args)
+	}
+	_, err := tx.Exec(query, args...)
+	if err != nil {
+		lib.QueryOut(query, args...)
+		return err
+	}
+	return nil
+}
+
+// storeState stores last_calculated_at for a given calculation key in V3_STATE_TABLE (if set)
+func storeState(tx *sql.Tx, timeRange, projectSlug, dtFrom, dtTo string, calcDt time.Time, duration time.Duration, debug bool, env map[string]string) error {
+	stateTable, _ := env["STATE_TABLE"]
+	if stateTable == "" {
+		return nil
+	}
+	keyCols := "time_range, project_slug, date_from, date_to"
+	metricCol := ""
+	args := []interface{}{timeRange, projectSlug, dtFrom, dtTo}
+	_, storeMetric := env["STORE_METRIC_NAME"]
+	if storeMetric {
+		metric, _ := env["METRIC"]
+		keyCols += ", metric"
+		metricCol = "  metric text not null,\n"
+		args = append(args, metric)
+	}
+	args = append(args, calcDt)
+	createTable := fmt.Sprintf(`create table if not exists "%s"(
+  time_range varchar(6) not null,
+  project_slug text not null,
+  date_from date not null,
+  date_to date not null,
+  last_calculated_at timestamp not null,
+%s  primary key(%s)
+)`,
+		stateTable,
+		metricCol,
+		keyCols,
+	)
+	cols := keyCols + ", last_calculated_at"
+	updateSet := "last_calculated_at = excluded.last_calculated_at"
+	version, err := metricVersion(env)
+	if err != nil {
+		return err
+	}
+	if version != "" {
+		createTable += fmt.Sprintf(`;
+alter table "%s" add column if not exists metric_version text`,
+			stateTable,
+		)
+		cols += ", metric_version"
+		updateSet = "(last_calculated_at, metric_version) = (excluded.last_calculated_at, excluded.metric_version)"
+		args = append(args, version)
+	}
+	_, recordDuration := env["RECORD_DURATION"]
+	if recordDuration {
+		createTable += fmt.Sprintf(`;
+alter table "%s" add column if not exists calc_duration_ms bigint`,
+			stateTable,
+		)
+		cols += ", calc_duration_ms"
+		updateSet += ", calc_duration_ms = excluded.calc_duration_ms"
+		args = append(args, duration.Milliseconds())
+	}
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	query := fmt.Sprintf(
+		`insert into "%s"(%s) values (%s) on conflict(%s) do update set %s`,
+		stateTable,
+		cols,
+		strings.Join(placeholders, ", "),
+		keyCols,
+		updateSet,
+	)
+	if debug {
+		lib.Logf("state table:\n%s\n%s\n%+v\n", createTable, query, args)
+	}
+	_, err = tx.Exec(createTable)
+	if err != nil {
+		lib.QueryOut(createTable, []interface{}{}...)
+		return err
+	}
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		lib.QueryOut(query, args...)
+		return err
+	}
+	return nil
+}
+
+// batchSQL returns UPSERT query for nRows rows, each having nSynth synthetic columns followed by colNames columns
+// onConflict is appended as is, see conflictSQL
+// This is the type of query that we will be using (UPSERT):
+// insert into t(a, b, c) values (1, 2, 30), (4, 5, 60) on conflict(a, b) do update set (b, c) = (excluded.b, excluded.c);
+func batchSQL(table, synthCols, onConflict string, nSynth int, colNames []string, nRows int) string {
+	nCols := nSynth + len(colNames)
+	values := make([]string, nRows)
+	placeholders := make([]string, nCols)
+	for r := 0; r < nRows; r++ {
+		for j := 0; j < nCols; j++ {
+			placeholders[j] = fmt.Sprintf("$%d", r*nCols+j+1)
+		}
+		values[r] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	return fmt.Sprintf(
+		`insert into "%s"(%s, %s) values %s%s`,
+		table,
+		synthCols,
+		strings.Join(colNames, ", "),
+		strings.Join(values, ", "),
+		onConflict,
+	)
+}
+
+// flushBatch executes UPSERT for all rows in args and returns number of affected rows
+func flushBatch(tx *sql.Tx, table, synthCols, onConflict string, nSynth int, colNames []string, args []interface{}, debug bool) (int64, error) {
+	ep := nSynth + len(colNames)
+	// never send more bind parameters than the server accepts, split into smaller statements instead
+	if len(args) > gServerMaxPlaceholders {
+		step := (gServerMaxPlaceholders / ep) * ep
+		lib.Logf("warning: batch needs %d bind parameters, more than the server limit of %d, splitting it\n", len(args), gServerMaxPlaceholders)
+		affected := int64(0)
+		for start := 0; start < len(args); start += step {
+			end := start + step
+			if end > len(args) {
+				end = len(args)
+			}
+			nRows, err := flushBatch(tx, table, synthCols, onConflict, nSynth, colNames, args[start:end], debug)
+			if err != nil {
+				return 0, err
+			}
+			affected += nRows
+		}
+		return affected, nil
+	}
+	nBatchRows := len(args) / ep
+	sp := gTracer.start("flush", map[string]interface{}{"table": table, "rows": nBatchRows})
+	defer sp.finish(nil)
+	query := batchSQL(table, synthCols, onConflict, nSynth, colNames, nBatchRows)
+	if debug {
+		lib.Logf("query:\n%s\n", query)
+		lib.Logf("args(%d):\n%+v\n", len(args), args)
+	}
+	rslt, err := tx.Exec(query, args...)
+	if err != nil {
+		lib.QueryOut(query, args...)
+		return 0, &lib.ErrQuery{Query: query, Err: err}
+	}
+	nRows, err := rslt.RowsAffected()
+	if err != nil {
+		lib.QueryOut(query, args...)
+		return 0, err
+	}
+	return nRows, nil
+}
+
+// storeEmptyMarker inserts a marker row with row_number = -1 and null metric columns for an empty metric result
+// so isCalculated finds it, its last_calculated_at is updated when it already exists
+func storeEmptyMarker(tx *sql.Tx, table, synthCols, keyCols string, synthValues []interface{}, debug bool) error {
+	placeholders := []string{}
+	for i := range synthValues {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i+1))
+	}
+	query := fmt.Sprintf(
+		`insert into "%s"(%s) values (%s)%s`,
+		table,
+		synthCols,
+		strings.Join(placeholders, ", "),
+		conflictSQL(keyCols, "update", "", []string{"last_calculated_at"}, nil),
+	)
+	if debug {
+		lib.Logf("empty result marker query:\n%s\n%+v\n", query, synthValues)
+	}
+	_, err := tx.Exec(query, synthValues...)
+	if err != nil {
+		lib.QueryOut(query, synthValues...)
+		return err
+	}
+	return nil
+}
+
+// storeSummary stores a single summary row returned by summaryQuery as row_number = 0
+// summary columns must be a subset of metric columns, remaining columns will be null
+// summary query runs on the source connection (conn), so it uses the same session settings and snapshot as the metric SQL
+// versioned means synthCols include metric_version, which is then also updated on conflict
+func storeSummary(ctx context.Context, conn *sql.Conn, tx *sql.Tx, summaryQuery, table, synthCols, keyCols, conflictAction string, synthValues []interface{}, namesMap, compressMap, immutableMap map[string]struct{}, versioned, debug bool) (bool, error) {
+	if debug {
+		lib.Logf("summary SQL:\n%s\n", summaryQuery)
+	}
+	rows, err := conn.QueryContext(ctx, summaryQuery)
+	if err != nil {
+		lib.QueryOut(summaryQuery, []interface{}{}...)
+		return false, err
+	}
+	defer func() { _ = rows.Close() }()
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return false, err
+	}
+	columns := make([]string, len(columnTypes))
+	for i, column := range columnTypes {
+		columns[i] = column.Name()
+	}
+	for _, colName := range columns {
+		_, ok := namesMap[colName]
+		if !ok {
+			return false, fmt.Errorf("summary column '%s' is not returned by the metric SQL", colName)
+		}
+	}
+	pValues := make([]interface{}, len(columns))
+	for i, column := range columnTypes {
+		_, compress := compressMap[columns[i]]
+		pValues[i] = newScanDest(column, false, compress)
+	}
+	args := append([]interface{}{}, synthValues...)
+	fetched := false
+	for rows.Next() {
+		if fetched {
+			return false, fmt.Errorf("summary SQL must return at most one row")
+		}
+		err := rows.Scan(pValues...)
+		if err != nil {
+			return false, err
+		}
+		for j, pValue := range pValues {
+			_, compress := compressMap[columns[j]]
+			value, err := scannedValue(pValue, compress)
+			if err != nil {
+				return false, err
+			}
+			args = append(args, value)
+		}
+		fetched = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return false, err
+	}
+	if !fetched {
+		lib.Logf("summary SQL returned no rows\n")
+		return false, nil
+	}
+	placeholders := []string{}
+	for i := range args {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i+1))
+	}
+	updateCols := []string{"last_calculated_at"}
+	if versioned {
+		updateCols = append(updateCols, "metric_version")
+	}
+	for _, colName := range columns {
+		_, immutable := immutableMap[colName]
+		if !immutable {
+			updateCols = append(updateCols, colName)
+		}
+	}
+	query := fmt.Sprintf(
+		`insert into "%s"(%s, %s) values (%s)%s`,
+		table,
+		synthCols,
+		strings.Join(columns, ", "),
+		strings.Join(placeholders, ", "),
+		conflictSQL(keyCols, conflictAction, "", updateCols, nil),
+	)
+	if debug {
+		lib.Logf("summary query:\n%s\n", query)
+		lib.Logf("args(%d):\n%+v\n", len(args), args)
+	}
+	rslt, err := tx.Exec(query, args...)
+	if err != nil {
+		lib.QueryOut(query, args...)
+		return false, err
+	}
+	nRows, err := rslt.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return nRows > 0, nil
+}
+
+// pruneHistory keeps only keep newest snapshots for a given calculation key
+func pruneHistory(tx *sql.Tx, table, timeRange, projectSlug, dtFrom, dtTo string, keep int, debug bool, env map[string]string) error {
+	mCond, mArgs := metricCond(5, env)
+	delQuery := fmt.Sprintf(
+		`delete from "%s" where time_range = $1 and project_slug = $2 and date_from = $3 and date_to = $4%s and snapshot_at not in (select distinct snapshot_at from "%s" where time_range = $1 and project_slug = $2 and date_from = $3 and date_to = $4%s order by snapshot_at desc limit %d)`,
+		table,
+		mCond,
+		table,
+		mCond,
+		keep,
+	)
+	args := append([]interface{}{timeRange, projectSlug, dtFrom, dtTo}, mArgs...)
+	if debug {
+		lib.Logf("prune history:\n%s\n%+v\n", delQuery, args)
+	}
+	res, err := tx.Exec(delQuery, args...)
+	if err != nil {
+		lib.QueryOut(delQuery, args...)
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err == nil && rows > 0 {
+		lib.Logf("pruned %d history rows from \"%s\"(%s, %s, %s, %s), keeping %d snapshots\n", rows, table, projectSlug, timeRange, dtFrom, dtTo, keep)
+	}
+	return nil
+}
+
+// matviewName returns name of the materialized view holding a single (project_slug, time_range) calculation: table__project_range,
+// custom (c) time range windows also include dates, names longer than Postgres identifier limit are shortened using a hash
+func matviewName(table, projectSlug, timeRange string, dtf, dtt time.Time) string {
+	key := toDBIdentifier(projectSlug) + "_" + toDBIdentifier(timeRange)
+	if timeRange == "c" {
+		key += "_" + dtf.Format("20060102") + "_" + dtt.Format("20060102")
+	}
+	name := table + "__" + key
+	if len(name) > 63 {
+		name = fmt.Sprintf("%s_%x", name[:50], md5.Sum([]byte(name)))[:63]
+	}
+	return name
+}
+
+// calculateMatview creates or refreshes materialized view for a single calculation key (see matviewName)
+// view is recreated when its definition changed (for example time range window moved), otherwise it is refreshed
+func calculateMatview(db *sql.DB, sqlQuery, table, projectSlug, timeRange, dtFrom, dtTo string, ppt, debug bool, env map[string]string) error {
+	dtStart := time.Now()
+	// Materialized view is created from the templated metric SQL wrapped with our synthetic columns
+	// so Postgres materializes rows on its own and last_calculated_at becomes the view refresh time
+	percentileCol, _ := env["PERCENTILE_COLUMN"]
+	if percentileCol != "" {
+		return fmt.Errorf("%sPERCENTILE_COLUMN cannot be used with materialized view output, use percent_rank() in the metric SQL instead", gPrefix)
+	}
+	pctOfTotal, _ := env["PCT_OF_TOTAL"]
+	if pctOfTotal != "" {
+		return fmt.Errorf("%sPCT_OF_TOTAL cannot be used with materialized view output, use a window function (sum() over ()) in the metric SQL instead", gPrefix)
+	}
+	minRows, maxRows, _ := expectedRows(env)
+	if minRows > 0 || maxRows > 0 {
+		return fmt.Errorf("%sEXPECT_MIN_ROWS and %sEXPECT_MAX_ROWS cannot be used with materialized view output", gPrefix, gPrefix)
+	}
+	_, latestView := env["CREATE_LATEST_VIEW"]
+	if latestView {
+		return fmt.Errorf("%sCREATE_LATEST_VIEW cannot be used with materialized view output", gPrefix)
+	}
+	_, unlogged := env["UNLOGGED"]
+	if unlogged {
+		return fmt.Errorf("%sUNLOGGED cannot be used with materialized view output, materialized views cannot be unlogged", gPrefix)
+	}
+	snapshot, _ := env["SNAPSHOT_ID"]
+	if snapshot != "" {
+		return fmt.Errorf("%sSNAPSHOT_ID cannot be used with materialized view output, view refresh always sees the current data", gPrefix)
+	}
+	sqlQuery = trimSQL(sqlQuery)
+	metricCol := ""
+	_, storeMetric := env["STORE_METRIC_NAME"]
+	if storeMetric {
+		metric, _ := env["METRIC"]
+		metricCol = fmt.Sprintf("  %s::text as metric,\n", pq.QuoteLiteral(metric))
+	}
+	version, err := metricVersion(env)
+	if err != nil {
+		return err
+	}
+	rnType, rnStart, err := rowNumberOptions(env)
+	if err != nil {
+		return err
+	}
+	if version != "" {
+		metricCol += fmt.Sprintf("  %s::text as metric_version,\n", pq.QuoteLiteral(version))
+	}
+	createView := fmt.Sprintf(`create materialized view "%s" as
+select
+  %s::varchar(6) as time_range,
+  %s::text as project_slug,
+  now()::timestamp as last_calculated_at,
+  %s::date as date_from,
+  %s::date as date_to,
+  (row_number() over () + %d)::%s as row_number,
+%s  m.*
+from (
+%s
+) m;
+`,
+		table,
+		pq.QuoteLiteral(timeRange),
+		pq.QuoteLiteral(projectSlug),
+		pq.QuoteLiteral(dtFrom),
+		pq.QuoteLiteral(dtTo),
+		rnStart-1,
+		rnType,
+		metricCol,
+		sqlQuery,
+	)
+	createView += fmt.Sprintf(`create unique index if not exists "%s_pkey_idx" on "%s"(time_range, project_slug, date_from, date_to, row_number);
+`,
+		table,
+		table,
+	)
+	_, noTimeRangeIndex := env["NO_TIME_RANGE_INDEX"]
+	_, noProjectIndex := env["NO_PROJECT_INDEX"]
+	if !noTimeRangeIndex {
+		createView += fmt.Sprintf(`create index if not exists "%s_time_range_idx" on "%s"(time_range);
+`,
+			table,
+			table,
+		)
+	}
+	if !ppt && !noProjectIndex {
+		createView += fmt.Sprintf(`create index if not exists "%s_project_slug_idx" on "%s"(project_slug);
+`,
+			table,
+			table,
+		)
+	}
+	indices, ok := env["INDEXED_COLUMNS"]
+	if ok && indices != "" {
+		for _, index := range strings.Split(indices, ",") {
+			createView += fmt.Sprintf(`create index if not exists "%s_%s_idx" on "%s"(%s);
+`,
+				table,
+				index,
+				table,
+				index,
+			)
+		}
+	}
+	// definition hash is stored as the view comment, so unchanged views are only refreshed
+	definition := fmt.Sprintf("calcmetric:%x", md5.Sum([]byte(createView)))
+	createView += fmt.Sprintf(`comment on materialized view "%s" is %s;
+`,
+		table,
+		pq.QuoteLiteral(definition),
+	)
+	if debug {
+		lib.Logf("create materialized view:\n%s\n", createView)
+	}
+	_, printDDL := env["PRINT_DDL"]
+	if printDDL {
+		fmt.Printf("%s", createView)
+		setFinalState(lib.StateCalculated)
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	lockTimeout := lockTimeoutSQL(env)
+	if lockTimeout != "" {
+		_, err = tx.Exec(lockTimeout)
+		if err != nil {
+			return err
+		}
+	}
+	var current sql.NullString
+	commentQuery := `select obj_description(to_regclass($1), 'pg_class')`
+	err = tx.QueryRow(commentQuery, `"`+table+`"`).Scan(&current)
+	if err != nil {
+		lib.QueryOut(commentQuery, table)
+		return err
+	}
+	query := fmt.Sprintf(`refresh materialized view concurrently "%s"`, table)
+	if current.String != definition {
+		query = fmt.Sprintf(`drop materialized view if exists "%s";
+%s`,
+			table,
+			createView,
+		)
+	}
+	if debug {
+		lib.Logf("materialized view query:\n%s\n", query)
+	}
+	_, err = tx.Exec(query)
+	if err != nil {
+		lib.QueryOut(query, []interface{}{}...)
+		logLockTimeout(err, env)
+		return err
+	}
+	var nRows int64
+	countQuery := fmt.Sprintf(`select count(*) from "%s"`, table)
+	err = tx.QueryRow(countQuery).Scan(&nRows)
+	if err != nil {
+		lib.QueryOut(countQuery, []interface{}{}...)
+		return err
+	}
+	err = storeState(tx, timeRange, projectSlug, dtFrom, dtTo, time.Now(), time.Since(dtStart), debug, env)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	committed = true
+	if nRows > 0 {
+		setFinalState(lib.StateCalculated)
+	}
+	lib.Logf("materialized view '%s' refreshed with %d rows\n", table, nRows)
+	return nil
+}
+
+// nowTime returns the reference time for time ranges: V3_NOW (parsed by TimeParseAny) if set or current time
+// this allows deterministic backfills ("calculate as if it was date X")
+func nowTime(env map[string]string) (time.Time, error) {
+	now, ok := env["NOW"]
+	if !ok || now == "" {
+		return time.Now(), nil
+	}
+	dt, err := lib.TimeParseAny(now)
+	if err != nil {
+		return dt, &lib.ErrParse{What: gPrefix + "NOW", Err: err}
+	}
+	return dt, nil
+}
+
+// prevMode returns V3_PREV_MODE: prior (default) - previous periods are shifted by one period,
+// yoy - previous periods are the same periods one year earlier
+func prevMode(env map[string]string) (string, error) {
+	mode, _ := env["PREV_MODE"]
+	switch mode {
+	case "":
+		return "prior", nil
+	case "prior", "yoy":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown %sPREV_MODE: '%s', allowed values are: prior, yoy", gPrefix, mode)
+	}
+}
+
+// ytdPrevMode returns V3_YTD_PREV - how typ (previous year to date) is computed:
+// elapsed - year to date shifted back by its own elapsed length, yoy - the same days of the prior year
+// when not set it follows V3_PREV_MODE: elapsed for prior, yoy for yoy
+func ytdPrevMode(env map[string]string) (string, error) {
+	mode, _ := env["YTD_PREV"]
+	switch mode {
+	case "":
+		pMode, err := prevMode(env)
+		if err != nil {
+			return "", err
+		}
+		if pMode == "yoy" {
+			return "yoy", nil
+		}
+		return "elapsed", nil
+	case "elapsed", "yoy":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown %sYTD_PREV: '%s', allowed values are: elapsed, yoy", gPrefix, mode)
+	}
+}
+
+func currentTimeRange(timeRange string, debug bool, env map[string]string) (time.Time, time.Time) {
+	// V3_NOW, V3_PREV_MODE and V3_YTD_PREV are validated in runMetric
+	now, _ := nowTime(env)
+	if debug && env["NOW"] != "" {
+		lib.Logf("using %sNOW=%s as the current time: %s\n", gPrefix, env["NOW"], lib.ToYMDHMS(now))
+	}
+	// with yoy mode previous periods are current periods shifted by one year
+	yoy := false
+	mode, _ := prevMode(env)
+	// typ is handled by V3_YTD_PREV
+	if mode == "yoy" && timeRange != "a" && timeRange != "typ" && strings.HasSuffix(timeRange, "p") {
+		timeRange = strings.TrimSuffix(timeRange, "p")
+		yoy = true
+	}
+	dtf, dtt := now, now
+	switch timeRange {
+	case "7d", "7dp":
+		_, daily := env["CALC_WEEK_DAILY"]
+		if daily {
+			dtt = lib.DayStart(now)
+			dtf = dtt.AddDate(0, 0, -7)
+		} else {
+			firstDay := time.Monday
+			weekStart, _ := env["WEEK_START"]
+			switch strings.ToLower(weekStart) {
+			case "", "monday":
+			case "sunday":
+				firstDay = time.Sunday
+			default:
+				lib.Logf("unknown %sWEEK_START value: '%s', assuming monday\n", gPrefix, weekStart)
+			}
+			dtt = lib.WeekStartOn(now, firstDay)
+			dtf = dtt.AddDate(0, 0, -7)
+		}
+		if timeRange == "7dp" {
+			dtf = dtf.AddDate(0, 0, -7)
+			dtt = dtt.AddDate(0, 0, -7)
+		}
+	case "30d", "30dp":
+		_, daily := env["CALC_MONTH_DAILY"]
+		if daily {
+			dtt = lib.DayStart(now)
+			dtf = dtt.AddDate(0, 0, -30)
+			if timeRange == "30dp" {
+				dtf = dtf.AddDate(0, 0, -30)
+				dtt = dtt.AddDate(0, 0, -30)
+			}
+		} else {
+			dtt = lib.MonthStart(now)
+			dtf = dtt.AddDate(0, -1, 0)
+			if timeRange == "30dp" {
+				dtf = dtf.AddDate(0, -1, 0)
+				dtt = dtt.AddDate(0, -1, 0)
+			}
+		}
+	case "q", "qp":
+		_, daily := env["CALC_QUARTER_DAILY"]
+		if daily {
+			dtt = lib.DayStart(now)
+			dtf = dtt.AddDate(0, -3, 0)
+			if timeRange == "qp" {
+				dtf = dtf.AddDate(0, -3, 0)
+				dtt = dtt.AddDate(0, -3, 0)
+			}
+		} else {
+			dtt = lib.QuarterStart(now)
 			dtf = dtt.AddDate(0, -3, 0)
 			if timeRange == "qp" {
 				dtf = dtf.AddDate(0, -3, 0)
 				dtt = dtt.AddDate(0, -3, 0)
 			}
 		}
-	case "ty", "typ":
-		dtt = lib.DayStart(now)
-		dtf = lib.YearStart(now)
-		if timeRange == "typ" {
-			diff := dtt.Sub(dtf)
-			dtf = dtf.Add(-diff)
-			dtt = dtt.Add(-diff)
+	case "ty", "typ":
+		dtt = lib.DayStart(now)
+		dtf = lib.YearStart(now)
+		if timeRange == "typ" {
+			ytdPrev, _ := ytdPrevMode(env)
+			if ytdPrev == "yoy" {
+				dtf = dtf.AddDate(-1, 0, 0)
+				dtt = dtt.AddDate(-1, 0, 0)
+			} else {
+				diff := dtt.Sub(dtf)
+				dtf = dtf.Add(-diff)
+				dtt = dtt.Add(-diff)
+			}
+		}
+	case "y", "yp":
+		_, daily := env["CALC_YEAR_DAILY"]
+		if daily {
+			dtt = lib.DayStart(now)
+			dtf = dtt.AddDate(-1, 0, 0)
+			if timeRange == "yp" {
+				dtf = dtf.AddDate(-1, 0, 0)
+				dtt = dtt.AddDate(-1, 0, 0)
+			}
+		} else {
+			dtt = lib.YearStart(now)
+			dtf = dtt.AddDate(-1, 0, 0)
+			if timeRange == "yp" {
+				dtf = dtf.AddDate(-1, 0, 0)
+				dtt = dtt.AddDate(-1, 0, 0)
+			}
+		}
+	case "2y", "2yp":
+		_, daily := env["CALC_YEAR2_DAILY"]
+		if daily {
+			dtt = lib.DayStart(now)
+			dtf = dtt.AddDate(-2, 0, 0)
+			if timeRange == "2yp" {
+				dtf = dtf.AddDate(-2, 0, 0)
+				dtt = dtt.AddDate(-2, 0, 0)
+			}
+		} else {
+			dtt = lib.YearStart(now)
+			if now.Year()%2 == 1 {
+				dtt = dtt.AddDate(-1, 0, 0)
+			}
+			dtf = dtt.AddDate(-2, 0, 0)
+			if timeRange == "2yp" {
+				dtf = dtf.AddDate(-2, 0, 0)
+				dtt = dtt.AddDate(-2, 0, 0)
+			}
+		}
+	case "a":
+		dtt, _ = lib.TimeParseAny("2100")
+		dtf, _ = lib.TimeParseAny("1970")
+		if timeRange == "typ" {
+			diff := dtt.Sub(dtf)
+			dtf = dtf.Add(-diff)
+			dtt = dtt.Add(-diff)
+		}
+	}
+	if yoy {
+		dtf = dtf.AddDate(-1, 0, 0)
+		dtt = dtt.AddDate(-1, 0, 0)
+	}
+	lib.Logf("checking for time range %s - %s\n", lib.ToYMDQuoted(dtf), lib.ToYMDQuoted(dtt))
+	return dtf, dtt
+}
+
+func previousTimeRange(timeRange string, dtf, dtt time.Time, debug bool, env map[string]string) (time.Time, time.Time, error) {
+	switch timeRange {
+	case "7d", "30d", "q", "ty", "y", "2y":
+		mode, _ := prevMode(env)
+		if mode == "yoy" && timeRange == "2y" {
+			return dtf, dtt, fmt.Errorf("time range '%s' has no previous period with %sPREV_MODE=yoy", timeRange, gPrefix)
+		}
+		pdtf, pdtt := currentTimeRange(timeRange+"p", debug, env)
+		return pdtf, pdtt, nil
+	case "c":
+		mode, _ := prevMode(env)
+		if mode == "yoy" {
+			return dtf.AddDate(-1, 0, 0), dtt.AddDate(-1, 0, 0), nil
+		}
+		diff := dtt.Sub(dtf)
+		if inclusiveDateTo(env) {
+			diff = lib.NextDayStart(dtt).Sub(dtf)
+		}
+		return dtf.Add(-diff), dtt.Add(-diff), nil
+	default:
+		return dtf, dtt, fmt.Errorf("time range '%s' has no previous period", timeRange)
+	}
+}
+
+func trimSQL(sqlQuery string) string {
+	return strings.TrimRight(strings.TrimSpace(sqlQuery), ";")
+}
+
+// topLevelSQL returns lower case SQL with all quoted strings, comments and parenthesized parts blanked out
+func topLevelSQL(sqlQuery string) string {
+	sqlQuery = strings.ToLower(sqlQuery)
+	out := []byte(sqlQuery)
+	depth := 0
+	n := len(sqlQuery)
+	for i := 0; i < n; i++ {
+		c := sqlQuery[i]
+		switch {
+		case c == '\'' || c == '"':
+			j := i + 1
+			for j < n && sqlQuery[j] != c {
+				j++
+			}
+			for ; i <= j && i < n; i++ {
+				out[i] = ' '
+			}
+			i--
+			continue
+		case c == '-' && i+1 < n && sqlQuery[i+1] == '-':
+			for ; i < n && sqlQuery[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+			i--
+			continue
+		case c == '/' && i+1 < n && sqlQuery[i+1] == '*':
+			j := strings.Index(sqlQuery[i+2:], "*/")
+			end := n
+			if j >= 0 {
+				end = i + j + 4
+			}
+			for ; i < end; i++ {
+				out[i] = ' '
+			}
+			i--
+			continue
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			out[i] = ' '
+			continue
+		}
+		if depth > 0 {
+			out[i] = ' '
+		}
+	}
+	return string(out)
+}
+
+func hasTopLevelOrderBy(sqlQuery string) bool {
+	return gOrderByRe.MatchString(topLevelSQL(sqlQuery))
+}
+
+// orderedSQL makes sure that metric SQL returns rows in a deterministic order, so row_number is stable between runs
+func orderedSQL(sqlQuery, orderBy string, debug bool) string {
+	if hasTopLevelOrderBy(sqlQuery) {
+		if orderBy != "" && debug {
+			lib.Logf("metric SQL already has a top level order by, not adding '%s'\n", orderBy)
+		}
+		return sqlQuery
+	}
+	if orderBy == "" {
+		lib.Logf("warning: metric SQL has no top level order by, row_number assignment can differ between runs, consider setting %sORDER_BY\n", gPrefix)
+		return sqlQuery
+	}
+	return fmt.Sprintf("select * from (\n%s\n) o order by %s\n", trimSQL(sqlQuery), orderBy)
+}
+
+func renderSQL(sqlQuery, projectSlug string, dtf, dtt time.Time, env map[string]string) string {
+	sqlQuery = strings.Replace(sqlQuery, "{{project_slug}}", projectSlug, -1)
+	if strings.Contains(sqlQuery, "{{project_slugs}}") {
+		sqlQuery = strings.Replace(sqlQuery, "{{project_slugs}}", projectSlugsSQL(projectSlug, env), -1)
+	}
+	limit, _ := env["LIMIT"]
+	if limit != "" {
+		sqlQuery = strings.Replace(sqlQuery, "{{limit}}", limit, -1)
+	}
+	offset, _ := env["OFFSET"]
+	if offset != "" {
+		sqlQuery = strings.Replace(sqlQuery, "{{offset}}", offset, -1)
+	}
+	for k, v := range env {
+		if strings.HasPrefix(k, "PARAM_") && !strings.HasPrefix(k, "PARAM_FILE_") {
+			n := k[6:]
+			sqlQuery = strings.Replace(sqlQuery, "{{"+n+"}}", v, -1)
+		}
+	}
+	// user provided date_to is the last included day, SQL gets the next day start, so `< {{date_to}}` includes it
+	if inclusiveDateTo(env) {
+		dtt = lib.NextDayStart(dtt)
+	}
+	// {{name|default}} uses V3_PARAM_name when set and default otherwise
+	sqlQuery = gParamDefaultRe.ReplaceAllStringFunc(sqlQuery, func(match string) string {
+		m := gParamDefaultRe.FindStringSubmatch(match)
+		v, ok := env["PARAM_"+m[1]]
+		if ok {
+			return v
+		}
+		return m[2]
+	})
+	sqlQuery = strings.Replace(sqlQuery, "{{date_from}}", lib.ToYMDQuoted(dtf), -1)
+	sqlQuery = strings.Replace(sqlQuery, "{{date_to}}", lib.ToYMDQuoted(dtt), -1)
+	// timestamp boundaries for filtering timestamp columns, date_to is exclusive: ts >= {{date_from_ts}} and ts < {{date_to_ts}}
+	sqlQuery = strings.Replace(sqlQuery, "{{date_from_ts}}", "'"+lib.ToYMDHMS(lib.DayStart(dtf))+"'", -1)
+	sqlQuery = strings.Replace(sqlQuery, "{{date_to_ts}}", "'"+lib.ToYMDHMS(lib.DayStart(dtt))+"'", -1)
+	return sqlQuery
+}
+
+// inclusiveDateTo returns true when user provided date_to (V3_DATE_TO for c and V3_DATES for list time range)
+// is the last included day (V3_DATE_TO_EXCLUSIVE), built-in time ranges and range windows always end with an exclusive date_to
+func inclusiveDateTo(env map[string]string) bool {
+	_, exclusive := env["DATE_TO_EXCLUSIVE"]
+	if !exclusive {
+		return false
+	}
+	timeRange, _ := env["TIME_RANGE"]
+	return timeRange == "c" || timeRange == "list"
+}
+
+// loadParamFiles sets V3_PARAM_xyz values from files specified by V3_PARAM_FILE_xyz (for large params like ids lists)
+// file contents are used as is, only trailing whitespace is removed
+func loadParamFiles(env map[string]string) error {
+	files := make(map[string]string)
+	for k, v := range env {
+		if strings.HasPrefix(k, "PARAM_FILE_") {
+			files[k[11:]] = v
+		}
+	}
+	for name, file := range files {
+		_, ok := env["PARAM_"+name]
+		if ok {
+			return fmt.Errorf("both %sPARAM_%s and %sPARAM_FILE_%s are specified", gPrefix, name, gPrefix, name)
+		}
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("cannot read %sPARAM_FILE_%s '%s': %+v", gPrefix, name, file, err)
+		}
+		env["PARAM_"+name] = strings.TrimRight(string(contents), " \t\r\n")
+	}
+	return nil
+}
+
+// dailyBreakdownSQL returns period metric SQL combined with the same metric calculated for each day of the period (V3_DAILY_BREAKDOWN)
+// all rows get sub_date column: day for daily rows and 'infinity' for the whole period rows (they come last)
+func dailyBreakdownSQL(periodSQL, contents, subContents, projectSlug string, dtf, dtt time.Time, orderBy string, debug bool, env map[string]string) (string, error) {
+	lastDayIncluded := inclusiveDateTo(env)
+	parts := []string{}
+	for day := lib.DayStart(dtf); day.Before(dtt) || (lastDayIncluded && day.Equal(lib.DayStart(dtt))); day = lib.NextDayStart(day) {
+		if len(parts) >= gMaxBreakdownDays {
+			return "", fmt.Errorf("%sDAILY_BREAKDOWN supports periods up to %d days", gPrefix, gMaxBreakdownDays)
+		}
+		dayTo := lib.NextDayStart(day)
+		if lastDayIncluded {
+			dayTo = day
+		}
+		sql, err := metricSQL(contents, subContents, projectSlug, day, dayTo, env)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("select %s::date as sub_date, d.* from (\n%s\n) d", lib.ToYMDQuoted(day), trimSQL(orderedSQL(sql, orderBy, false))))
+	}
+	parts = append(parts, fmt.Sprintf("select 'infinity'::date as sub_date, p.* from (\n%s\n) p", trimSQL(periodSQL)))
+	if debug {
+		lib.Logf("daily breakdown: %d days\n", len(parts)-1)
+	}
+	order := "sub_date"
+	if orderBy != "" {
+		order += ", " + orderBy
+	}
+	return fmt.Sprintf("select * from (\n%s\n) b order by %s\n", strings.Join(parts, "\nunion all\n"), order), nil
+}
+
+// metricSQL renders metric SQL for a given window, when subtracted metric SQL is given it returns their difference
+func metricSQL(contents, subContents, projectSlug string, dtf, dtt time.Time, env map[string]string) (string, error) {
+	sql := renderSQL(contents, projectSlug, dtf, dtt, env)
+	if subContents == "" {
+		return sql, nil
+	}
+	return subtractSQL(sql, renderSQL(subContents, projectSlug, dtf, dtt, env), env)
+}
+
+// subtractSQL returns SQL computing difference of two metrics matched on V3_SUBTRACT_KEY columns
+// without V3_SUBTRACT_COLUMNS this is a set difference - rows of a not present in b
+// with V3_SUBTRACT_COLUMNS it returns key columns and a.col - b.col for each of the columns
+func subtractSQL(aSQL, bSQL string, env map[string]string) (string, error) {
+	keys, _ := env["SUBTRACT_KEY"]
+	if keys == "" {
+		return "", fmt.Errorf("you must specify %sSUBTRACT_KEY when using %sMETRIC_SUBTRACT", gPrefix, gPrefix)
+	}
+	conds := []string{}
+	keyCols := []string{}
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		conds = append(conds, fmt.Sprintf("a.%s is not distinct from b.%s", key, key))
+		keyCols = append(keyCols, "  a."+key)
+	}
+	cols, _ := env["SUBTRACT_COLUMNS"]
+	exprs := []string{}
+	for _, col := range strings.Split(cols, ",") {
+		col = strings.TrimSpace(col)
+		if col == "" {
+			continue
+		}
+		exprs = append(exprs, fmt.Sprintf("  a.%s - coalesce(b.%s, 0) as %s", col, col, col))
+	}
+	if len(exprs) == 0 {
+		return fmt.Sprintf(`select
+  a.*
+from (
+%s
+) a
+where not exists (
+  select 1 from (
+%s
+  ) b
+  where %s
+)
+`,
+			trimSQL(aSQL),
+			trimSQL(bSQL),
+			strings.Join(conds, " and "),
+		), nil
+	}
+	return fmt.Sprintf(`select
+%s,
+%s
+from (
+%s
+) a
+left join (
+%s
+) b
+on %s
+`,
+		strings.Join(keyCols, ",\n"),
+		strings.Join(exprs, ",\n"),
+		trimSQL(aSQL),
+		trimSQL(bSQL),
+		strings.Join(conds, " and "),
+	), nil
+}
+
+// deltaSQL joins current and previous period results on DELTA_KEY column(s)
+// and adds <column>_delta and <column>_pct_change for every DELTA_COLUMNS column
+func deltaSQL(currSQL, prevSQL string, env map[string]string) (string, error) {
+	keys, _ := env["DELTA_KEY"]
+	if keys == "" {
+		return "", fmt.Errorf("you must specify %sDELTA_KEY when using %sDELTA_COLUMNS", gPrefix, gPrefix)
+	}
+	conds := []string{}
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		conds = append(conds, fmt.Sprintf("c.%s is not distinct from p.%s", key, key))
+	}
+	cols, _ := env["DELTA_COLUMNS"]
+	exprs := []string{}
+	for _, col := range strings.Split(cols, ",") {
+		col = strings.TrimSpace(col)
+		if col == "" {
+			continue
+		}
+		exprs = append(
+			exprs,
+			fmt.Sprintf("  c.%s - coalesce(p.%s, 0) as %s_delta", col, col, col),
+			fmt.Sprintf("  case when coalesce(p.%s, 0) = 0 then null else 100.0 * (c.%s - p.%s) / p.%s end as %s_pct_change", col, col, col, col, col),
+		)
+	}
+	if len(exprs) == 0 {
+		return "", fmt.Errorf("no columns specified in %sDELTA_COLUMNS", gPrefix)
+	}
+	return fmt.Sprintf(`select
+  c.*,
+%s
+from (
+%s
+) c
+left join (
+%s
+) p
+on %s
+`,
+		strings.Join(exprs, ",\n"),
+		trimSQL(currSQL),
+		trimSQL(prevSQL),
+		strings.Join(conds, " and "),
+	), nil
+}
+
+func timeRangeDates(timeRange string, debug bool, env map[string]string) (time.Time, time.Time, error) {
+	var tm time.Time
+	switch timeRange {
+	case "7d", "7dp", "30d", "30dp", "q", "qp", "ty", "typ", "y", "yp", "2y", "2yp", "a":
+		// two years periods shifted by one year would overlap with the current period
+		mode, _ := prevMode(env)
+		if mode == "yoy" && timeRange == "2yp" {
+			return tm, tm, fmt.Errorf("time range '%s' is not supported with %sPREV_MODE=yoy", timeRange, gPrefix)
+		}
+		dtf, dtt := currentTimeRange(timeRange, debug, env)
+		return dtf, dtt, nil
+	case "c":
+		dtFrom, ok := env["DATE_FROM"]
+		if !ok {
+			return tm, tm, fmt.Errorf("you must specify %sDATE_FROM when using %sTIME_RANGE=c", gPrefix, gPrefix)
+		}
+		dtTo, ok := env["DATE_TO"]
+		if !ok {
+			return tm, tm, fmt.Errorf("you must specify %sDATE_TO when using %sTIME_RANGE=c", gPrefix, gPrefix)
+		}
+		dtf, err := lib.TimeParseAny(dtFrom)
+		if err != nil {
+			return tm, tm, err
+		}
+		dtt, err := lib.TimeParseAny(dtTo)
+		if err != nil {
+			return dtf, tm, err
+		}
+		return lib.DayStart(dtf), lib.DayStart(dtt), nil
+	default:
+		return tm, tm, fmt.Errorf("unknown time range: '%s'", timeRange)
+	}
+}
+
+// listWindows parses DATES: comma separated list of date_from:date_to pairs
+func listWindows(env map[string]string) ([][2]time.Time, error) {
+	dates, _ := env["DATES"]
+	if dates == "" {
+		return nil, fmt.Errorf("you must specify %sDATES when using %sTIME_RANGE=list", gPrefix, gPrefix)
+	}
+	windows := [][2]time.Time{}
+	for _, pair := range strings.Split(dates, ",") {
+		ary := strings.Split(strings.TrimSpace(pair), ":")
+		if len(ary) != 2 {
+			return nil, fmt.Errorf("invalid %sDATES entry: '%s', expected date_from:date_to", gPrefix, pair)
+		}
+		dtf, err := lib.TimeParseAny(ary[0])
+		if err != nil {
+			return nil, err
+		}
+		dtt, err := lib.TimeParseAny(ary[1])
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, [2]time.Time{lib.DayStart(dtf), lib.DayStart(dtt)})
+	}
+	return windows, nil
+}
+
+// matviews returns names of materialized views created for table by calculateMatview
+func matviews(db *sql.DB, table string) ([]string, error) {
+	like := strings.NewReplacer(`\`, `\\`, `_`, `\_`, `%`, `\%`).Replace(table) + `\_\_%`
+	query := `select matviewname from pg_matviews where schemaname = current_schema() and (matviewname = $1 or matviewname like $2)`
+	rows, err := db.Query(query, table, like)
+	if err != nil {
+		lib.QueryOut(query, table, like)
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	views := []string{}
+	for rows.Next() {
+		var view string
+		err = rows.Scan(&view)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	return views, rows.Err()
+}
+
+// backfillWindows splits BACKFILL_FROM - BACKFILL_TO into BACKFILL_STEP long windows
+// step is a number followed by d (days), w (weeks) or m (months), last window is truncated to BACKFILL_TO
+func backfillWindows(env map[string]string) ([][2]time.Time, error) {
+	for _, key := range []string{"BACKFILL_FROM", "BACKFILL_TO", "BACKFILL_STEP"} {
+		_, ok := env[key]
+		if !ok {
+			return nil, fmt.Errorf("you must specify %s%s when using %sTIME_RANGE=range", gPrefix, key, gPrefix)
+		}
+	}
+	dtf, err := lib.TimeParseAny(env["BACKFILL_FROM"])
+	if err != nil {
+		return nil, err
+	}
+	dtt, err := lib.TimeParseAny(env["BACKFILL_TO"])
+	if err != nil {
+		return nil, err
+	}
+	step := strings.TrimSpace(env["BACKFILL_STEP"])
+	if len(step) < 2 {
+		return nil, fmt.Errorf("invalid %sBACKFILL_STEP: '%s'", gPrefix, step)
+	}
+	n, err := strconv.Atoi(step[:len(step)-1])
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("%sBACKFILL_STEP must be positive, got: '%s'", gPrefix, step)
+	}
+	var next func(time.Time) time.Time
+	switch step[len(step)-1] {
+	case 'd':
+		next = func(dt time.Time) time.Time { return dt.AddDate(0, 0, n) }
+	case 'w':
+		next = func(dt time.Time) time.Time { return dt.AddDate(0, 0, 7*n) }
+	case 'm':
+		next = func(dt time.Time) time.Time { return dt.AddDate(0, n, 0) }
+	default:
+		return nil, fmt.Errorf("invalid %sBACKFILL_STEP unit: '%s', allowed: d, w, m", gPrefix, step)
+	}
+	dtf = lib.DayStart(dtf)
+	dtt = lib.DayStart(dtt)
+	windows := [][2]time.Time{}
+	for from := dtf; from.Before(dtt); from = next(from) {
+		to := next(from)
+		if to.After(dtt) {
+			to = dtt
+		}
+		windows = append(windows, [2]time.Time{from, to})
+	}
+	return windows, nil
+}
+
+// tracer collects spans of calculation phases and exports them to an OTLP/HTTP (JSON) collector at V3_OTEL_ENDPOINT
+// all spans are children of a single root span, which is a child of V3_TRACEPARENT (W3C trace context) when set
+// nil tracer (V3_OTEL_ENDPOINT not set) records nothing
+type tracer struct {
+	mtx      sync.Mutex
+	endpoint string
+	traceID  string
+	parentID string
+	root     *span
+	spans    []*span
+}
+
+// span is a single traced phase, attribute values can be strings or integers
+type span struct {
+	tr       *tracer
+	name     string
+	spanID   string
+	parentID string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+}
+
+// randomHex returns n random bytes as a hex string, crypto/rand is used so IDs from concurrent processes don't collide
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = crand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// newTracer returns a tracer for V3_OTEL_ENDPOINT (like http://localhost:4318) or nil when it is not set
+func newTracer(env map[string]string) (*tracer, error) {
+	endpoint, _ := env["OTEL_ENDPOINT"]
+	if endpoint == "" {
+		return nil, nil
+	}
+	tr := &tracer{endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces", traceID: randomHex(16)}
+	traceParent, _ := env["TRACEPARENT"]
+	if traceParent != "" {
+		// version-traceid-parentid-flags
+		ary := strings.Split(traceParent, "-")
+		if len(ary) != 4 || len(ary[1]) != 32 || len(ary[2]) != 16 {
+			return nil, fmt.Errorf("invalid %sTRACEPARENT '%s', expected 00-<32 hex trace id>-<16 hex parent id>-<flags>", gPrefix, traceParent)
+		}
+		tr.traceID, tr.parentID = strings.ToLower(ary[1]), strings.ToLower(ary[2])
+	}
+	metric, _ := env["METRIC"]
+	tr.root = &span{tr: tr, name: "calcmetric", spanID: randomHex(8), parentID: tr.parentID, start: time.Now(), attrs: map[string]interface{}{"metric": metric}}
+	return tr, nil
+}
+
+// start starts a child span of the root span
+func (tr *tracer) start(name string, attrs map[string]interface{}) *span {
+	if tr == nil {
+		return nil
+	}
+	return &span{tr: tr, name: name, spanID: randomHex(8), parentID: tr.root.spanID, start: time.Now(), attrs: attrs}
+}
+
+// finish ends the span adding extra attributes
+func (s *span) finish(attrs map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	for k, v := range attrs {
+		s.attrs[k] = v
+	}
+	s.tr.mtx.Lock()
+	s.tr.spans = append(s.tr.spans, s)
+	s.tr.mtx.Unlock()
+}
+
+// otlp returns span in OTLP JSON encoding
+func (s *span) otlp() map[string]interface{} {
+	attrs := []map[string]interface{}{}
+	for k, v := range s.attrs {
+		value := map[string]interface{}{}
+		switch tv := v.(type) {
+		case int:
+			value["intValue"] = strconv.Itoa(tv)
+		case int64:
+			value["intValue"] = strconv.FormatInt(tv, 10)
+		default:
+			value["stringValue"] = fmt.Sprintf("%v", tv)
+		}
+		attrs = append(attrs, map[string]interface{}{"key": k, "value": value})
+	}
+	o := map[string]interface{}{
+		"traceId":           s.tr.traceID,
+		"spanId":            s.spanID,
+		"name":              s.name,
+		"kind":              1,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        attrs,
+	}
+	if s.parentID != "" {
+		o["parentSpanId"] = s.parentID
+	}
+	return o
+}
+
+// flush ends the root span and exports all spans, export errors are only logged
+func (tr *tracer) flush(err error) {
+	if tr == nil {
+		return
+	}
+	attrs := map[string]interface{}{"final_state": gFinalState}
+	if err != nil {
+		attrs["error"] = err.Error()
+	}
+	tr.root.finish(attrs)
+	tr.mtx.Lock()
+	spans := []map[string]interface{}{}
+	for _, s := range tr.spans {
+		spans = append(spans, s.otlp())
+	}
+	tr.mtx.Unlock()
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{
+						map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "calcmetric"}},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "calcmetric"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	body, e := json.Marshal(payload)
+	if e != nil {
+		lib.Logf("otel: cannot encode spans: %+v\n", e)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, e := client.Post(tr.endpoint, "application/json", bytes.NewReader(body))
+	if e != nil {
+		lib.Logf("otel: cannot export spans to '%s': %+v\n", tr.endpoint, e)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		lib.Logf("otel: exporting spans to '%s' returned %s\n", tr.endpoint, resp.Status)
+		return
+	}
+	lib.Logf("otel: exported %d spans of trace %s\n", len(spans), tr.traceID)
+}
+
+// progress reports processed units count, elapsed time and ETA (when total is known)
+// lines are logged at most every V3_PROGRESS_INTERVAL seconds (0 - on every unit)
+type progress struct {
+	mtx      sync.Mutex
+	what     string
+	total    int
+	done     int
+	started  time.Time
+	last     time.Time
+	interval time.Duration
+}
+
+// newProgress returns a progress reporter for total units (0 - total unknown)
+func newProgress(what string, total int, defaultInterval time.Duration, env map[string]string) (*progress, error) {
+	pr := &progress{what: what, total: total, started: time.Now(), interval: defaultInterval}
+	pr.last = pr.started
+	pi, _ := env["PROGRESS_INTERVAL"]
+	if pi != "" {
+		secs, err := strconv.Atoi(pi)
+		if err != nil {
+			return nil, err
+		}
+		pr.interval = time.Duration(secs) * time.Second
+	}
+	return pr, nil
+}
+
+// step marks n units as processed and logs progress if needed
+func (pr *progress) step(n int) {
+	pr.mtx.Lock()
+	defer pr.mtx.Unlock()
+	pr.done += n
+	now := time.Now()
+	if now.Sub(pr.last) < pr.interval && pr.done != pr.total {
+		return
+	}
+	pr.last = now
+	elapsed := now.Sub(pr.started).Truncate(time.Second)
+	if pr.total <= 0 || pr.done == 0 {
+		lib.Logf("progress: processed %d %s, elapsed %v\n", pr.done, pr.what, elapsed)
+		return
+	}
+	left := pr.total - pr.done
+	if left < 0 {
+		left = 0
+	}
+	eta := time.Duration(int64(now.Sub(pr.started)) / int64(pr.done) * int64(left)).Truncate(time.Second)
+	lib.Logf("progress: processed %d/%d %s (%.1f%%), elapsed %v, ETA %v\n", pr.done, pr.total, pr.what, float64(pr.done)*100.0/float64(pr.total), elapsed, eta)
+}
+
+// backfill calculates all BACKFILL_STEP windows between BACKFILL_FROM and BACKFILL_TO as custom time ranges
+// already calculated windows are skipped, up to THREADS windows are calculated in parallel
+func backfill(db *sql.DB, table, projectSlug string, ppt, matview, debug bool, env map[string]string) error {
+	windows, err := backfillWindows(env)
+	if err != nil {
+		return err
+	}
+	thrN := 1
+	threads, _ := env["THREADS"]
+	if threads != "" {
+		thrN, err = strconv.Atoi(threads)
+		if err != nil {
+			return err
+		}
+		if thrN < 1 {
+			thrN = 1
+		}
+	}
+	nWindows := len(windows)
+	lib.Logf("backfill: %d windows, %d threads\n", nWindows, thrN)
+	pr, err := newProgress("windows", nWindows, 0, env)
+	if err != nil {
+		return err
+	}
+	var (
+		mtx        sync.Mutex
+		calculated int
+		skipped    int
+		firstErr   error
+	)
+	process := func(i int) error {
+		window := windows[i]
+		dtfs, dtts := lib.ToYMDQuoted(window[0]), lib.ToYMDQuoted(window[1])
+		lib.Logf("window %d of %d: %s - %s\n", i+1, nWindows, dtfs, dtts)
+		calc, err := calcRange(db, table, projectSlug, "c", window[0], window[1], ppt, matview, debug, env)
+		pr.step(1)
+		mtx.Lock()
+		defer mtx.Unlock()
+		if err != nil {
+			lib.Logf("window %d of %d: %s - %s: failed: %+v\n", i+1, nWindows, dtfs, dtts, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			return err
+		}
+		if calc {
+			calculated++
+			lib.Logf("window %d of %d: %s - %s: calculated\n", i+1, nWindows, dtfs, dtts)
+		} else {
+			skipped++
+			lib.Logf("window %d of %d: %s - %s: skipped\n", i+1, nWindows, dtfs, dtts)
+		}
+		return nil
+	}
+	if thrN > 1 {
+		ch := make(chan error)
+		nThreads := 0
+		for i := range windows {
+			go func(i int) { ch <- process(i) }(i)
+			nThreads++
+			if nThreads == thrN {
+				err := <-ch
+				nThreads--
+				if err != nil {
+					break
+				}
+			}
+		}
+		for nThreads > 0 {
+			<-ch
+			nThreads--
+		}
+	} else {
+		for i := range windows {
+			err := process(i)
+			if err != nil {
+				break
+			}
+		}
+	}
+	lib.Logf("backfill summary: %d windows, %d calculated, %d skipped\n", nWindows, calculated, skipped)
+	return firstErr
+}
+
+// touchRange updates last_calculated_at = now() for a given calculation key without recalculating (V3_TOUCH)
+// it also updates V3_STATE_TABLE if set, final state is set to 1 only if any rows were updated
+func touchRange(db *sql.DB, table, projectSlug, timeRange string, dtf, dtt time.Time, debug bool, env map[string]string) error {
+	df, dt := dateBinds(dtf, dtt, env)
+	tables := []string{table}
+	stateTable, _ := env["STATE_TABLE"]
+	if stateTable != "" {
+		tables = append(tables, stateTable)
+	}
+	mCond, mArgs := metricCond(5, env)
+	args := append([]interface{}{timeRange, projectSlug, df, dt}, mArgs...)
+	for _, tbl := range tables {
+		query := fmt.Sprintf(
+			`update "%s" set last_calculated_at = now() where time_range = $1 and project_slug = $2 and date_from = $3 and date_to = $4%s`,
+			tbl,
+			mCond,
+		)
+		if debug {
+			lib.Logf("touch:\n%s\n%+v\n", query, args)
+		}
+		res, err := db.Exec(query, args...)
+		if err != nil {
+			lib.QueryOut(query, args...)
+			return err
+		}
+		nRows, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		lib.Logf("touched %d rows in '%s' for (%s, %s, %s, %s)\n", nRows, tbl, projectSlug, timeRange, df, dt)
+		if nRows > 0 {
+			setFinalState(lib.StateCalculated)
+		}
+	}
+	return nil
+}
+
+// incrementalEnv returns env with {{last_calculated_at}} param set when metric SQL uses it: quoted latest last_calculated_at
+// stored for the time range and project (V3_STATE_TABLE is used when set), or V3_INCREMENTAL_FLOOR (default 1970-01-01)
+// when nothing was calculated yet (or there is no database connection in V3_PRINT_SQL mode)
+func incrementalEnv(db *sql.DB, table, projectSlug, timeRange string, debug bool, env map[string]string) (map[string]string, error) {
+	_, ok := env["PARAM_last_calculated_at"]
+	if ok {
+		return env, nil
+	}
+	metric, _ := env["METRIC"]
+	contents, err := includeSQL(env, metric, []string{})
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(contents, "{{last_calculated_at}}") {
+		return env, nil
+	}
+	floor, _ := env["INCREMENTAL_FLOOR"]
+	if floor == "" {
+		floor = "1970-01-01"
+	}
+	lastCalc, err := lib.TimeParseAny(floor)
+	if err != nil {
+		return nil, &lib.ErrParse{What: gPrefix + "INCREMENTAL_FLOOR", Err: err}
+	}
+	if db != nil {
+		stateTable, _ := env["STATE_TABLE"]
+		if stateTable != "" {
+			table = stateTable
+		}
+		mCond, mArgs := metricCond(3, env)
+		query := fmt.Sprintf(`select max(last_calculated_at) from "%s" where project_slug = $1 and time_range = $2%s`, table, mCond)
+		args := append([]interface{}{projectSlug, timeRange}, mArgs...)
+		var maxCalc sql.NullTime
+		err = db.QueryRow(query, args...).Scan(&maxCalc)
+		if err != nil {
+			e, ok := err.(*pq.Error)
+			if !ok || e.Code.Name() != "undefined_table" {
+				lib.QueryOut(query, args...)
+				return nil, err
+			}
+		}
+		if maxCalc.Valid {
+			lastCalc = maxCalc.Time
+		}
+	}
+	lib.Logf("incremental: {{last_calculated_at}} is %s\n", lib.ToYMDHMSf(lastCalc, 6))
+	sqlEnv := make(map[string]string)
+	for k, v := range env {
+		sqlEnv[k] = v
+	}
+	sqlEnv["PARAM_last_calculated_at"] = "'" + lib.ToYMDHMSf(lastCalc, 6) + "'"
+	return sqlEnv, nil
+}
+
+// buildSQL returns fully substituted metric SQL (with subtracted metric, delta columns and ordering) and summary SQL for a given window
+// it fails when any {{placeholder}} is left unresolved
+func buildSQL(projectSlug, timeRange string, dtf, dtt time.Time, debug bool, env map[string]string) (string, string, error) {
+	metric, _ := env["METRIC"]
+	contents, err := includeSQL(env, metric, []string{})
+	if err != nil {
+		return "", "", err
+	}
+	// metric can be computed as a difference of two metrics
+	subContents := ""
+	subtract, _ := env["METRIC_SUBTRACT"]
+	if subtract != "" {
+		subContents, err = includeSQL(env, subtract, []string{})
+		if err != nil {
+			return "", "", err
+		}
+	}
+	sql, err := metricSQL(contents, subContents, projectSlug, dtf, dtt, env)
+	if err != nil {
+		return "", "", err
+	}
+	_, delta := env["DELTA_COLUMNS"]
+	if delta {
+		pdtf, pdtt, err := previousTimeRange(timeRange, dtf, dtt, debug, env)
+		if err != nil {
+			return "", "", err
+		}
+		prevSQL, err := metricSQL(contents, subContents, projectSlug, pdtf, pdtt, env)
+		if err != nil {
+			return "", "", err
+		}
+		sql, err = deltaSQL(sql, prevSQL, env)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	orderBy, _ := env["ORDER_BY"]
+	sql = orderedSQL(sql, orderBy, debug)
+	_, breakdown := env["DAILY_BREAKDOWN"]
+	if breakdown {
+		if delta {
+			return "", "", fmt.Errorf("%sDAILY_BREAKDOWN cannot be used with %sDELTA_COLUMNS", gPrefix, gPrefix)
+		}
+		sql, err = dailyBreakdownSQL(sql, contents, subContents, projectSlug, dtf, dtt, orderBy, debug, env)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	summarySQL := ""
+	summary, _ := env["SUMMARY_METRIC"]
+	if summary != "" {
+		summaryContents, err := includeSQL(env, summary, []string{})
+		if err != nil {
+			return "", "", err
+		}
+		summarySQL = renderSQL(summaryContents, projectSlug, dtf, dtt, env)
+	}
+	err = checkPlaceholders(sql)
+	if err != nil {
+		return "", "", err
+	}
+	err = checkPlaceholders(summarySQL)
+	if err != nil {
+		return "", "", err
+	}
+	return sql, summarySQL, nil
+}
+
+// checkPlaceholders returns an error listing {{placeholders}} left in the rendered SQL
+func checkPlaceholders(sql string) error {
+	left := gPlaceholderRe.FindAllString(sql, -1)
+	if len(left) == 0 {
+		return nil
+	}
+	unique := []string{}
+	seen := make(map[string]struct{})
+	for _, placeholder := range left {
+		_, ok := seen[placeholder]
+		if !ok {
+			seen[placeholder] = struct{}{}
+			unique = append(unique, placeholder)
+		}
+	}
+	return fmt.Errorf("unresolved placeholders in SQL: %s, define them using %sPARAM_ variables", strings.Join(unique, ", "), gPrefix)
+}
+
+// calcRange checks if a given time range window needs calculation and calculates it
+// returns true if calculation was needed
+func calcRange(db *sql.DB, table, projectSlug, timeRange string, dtf, dtt time.Time, ppt, matview, debug bool, env map[string]string) (bool, error) {
+	_, touch := env["TOUCH"]
+	if touch {
+		return false, touchRange(db, table, projectSlug, timeRange, dtf, dtt, debug, env)
+	}
+	_, maintenanceOnly := env["MAINTENANCE_ONLY"]
+	if maintenanceOnly {
+		maintainRange(db, table, projectSlug, timeRange, dtf, dtt, matview, debug, env)
+		return false, nil
+	}
+	// printing DDL (and JSON only output) doesn't check or modify the current table state
+	_, printDDL := env["PRINT_DDL"]
+	out, err := outputTargets(env)
+	if err != nil {
+		return true, err
+	}
+	if matview {
+		table = matviewName(table, projectSlug, timeRange, dtf, dtt)
+	}
+	stateless := printDDL || out.stateless()
+	isCalc := false
+	spanAttrs := map[string]interface{}{"table": table, "project_slug": projectSlug, "time_range": timeRange}
+	if !stateless {
+		sp := gTracer.start("needsCalculation", spanAttrs)
+		isCalc, err = isCalculated(db, table, projectSlug, timeRange, debug, env, dtf, dtt)
+		if err != nil {
+			return true, err
+		}
+		sp.finish(map[string]interface{}{"needs_calculation": !isCalc})
+	}
+	deleted := false
+	if !matview && !stateless {
+		deleted = supportDelete(db, table, timeRange, projectSlug, dtf, dtt, debug, env)
+	}
+	if deleted {
+		isCalc, err = isCalculated(db, table, projectSlug, timeRange, debug, env, dtf, dtt)
+		if err != nil {
+			return true, err
+		}
+	}
+	needsCalc := !isCalc
+	if !needsCalc {
+		_, ok := env["FORCE_CALC"]
+		if ok {
+			needsCalc = true
+			lib.Logf("table '%s' doesn't need calculation but it was requested to calculate anyway\n", table)
+		}
+	}
+	if !needsCalc {
+		if debug {
+			lib.Logf("table '%s' doesn't need calculation now\n", table)
+		}
+		return false, nil
+	}
+	err = ensureBaseTable(env)
+	if err != nil {
+		return true, err
+	}
+	sqlEnv, err := incrementalEnv(db, table, projectSlug, timeRange, debug, env)
+	if err != nil {
+		return true, err
+	}
+	sql, summarySQL, err := buildSQL(projectSlug, timeRange, dtf, dtt, debug, sqlEnv)
+	if err != nil {
+		return true, err
+	}
+	dtfs, dtts := dateBinds(dtf, dtt, env)
+	if debug {
+		lib.Logf("generated SQL:\n%s\n", sql)
+	}
+	if matview {
+		return true, calculateMatview(db, sql, table, projectSlug, timeRange, dtfs, dtts, ppt, debug, env)
+	}
+	err = calculate(db, sql, summarySQL, table, projectSlug, timeRange, dtfs, dtts, ppt, debug, env)
+	if err != nil {
+		return true, err
+	}
+	if stateless {
+		return true, nil
+	}
+	sp := gTracer.start("cleanup", spanAttrs)
+	supportCleanup(db, table, timeRange, projectSlug, dtf, dtt, debug, env)
+	sp.finish(nil)
+	return true, nil
+}
+
+// parseDSN parses key=value connect string (values can be single quoted with backslash escapes)
+func parseDSN(dsn string) (map[string]string, error) {
+	params := make(map[string]string)
+	i, n := 0, len(dsn)
+	for {
+		for i < n && dsn[i] == ' ' {
+			i++
+		}
+		if i >= n {
+			return params, nil
+		}
+		eq := strings.Index(dsn[i:], "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("missing '=' after '%s'", dsn[i:])
+		}
+		key := strings.TrimSpace(dsn[i : i+eq])
+		i += eq + 1
+		for i < n && dsn[i] == ' ' {
+			i++
+		}
+		value := ""
+		if i < n && dsn[i] == '\'' {
+			i++
+			closed := false
+			for i < n {
+				if dsn[i] == '\\' && i+1 < n {
+					value += string(dsn[i+1])
+					i += 2
+					continue
+				}
+				if dsn[i] == '\'' {
+					closed = true
+					i++
+					break
+				}
+				value += string(dsn[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted value of '%s'", key)
+			}
+		} else {
+			for i < n && dsn[i] != ' ' {
+				value += string(dsn[i])
+				i++
+			}
+		}
+		params[key] = value
+	}
+}
+
+// redactPassword hides passwords from connect URLs (user:password@) and key=value connect strings (password=...)
+func redactPassword(str string) string {
+	str = gURLPasswordRe.ReplaceAllString(str, "${1}:redacted@")
+	return gDSNPasswordRe.ReplaceAllString(str, "password=redacted")
+}
+
+// connTarget validates connect string and returns "host:port as user" description (without password) for error messages
+// missing values are taken from standard PG* environment variables and defaults, like lib/pq does
+func connTarget(connStr string) (string, error) {
+	_, err := pq.NewConnector(connStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid %sCONN connect string: %s", gPrefix, redactPassword(err.Error()))
+	}
+	dsn := connStr
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		dsn, err = pq.ParseURL(connStr)
+		if err != nil {
+			return "", fmt.Errorf("invalid %sCONN connect URL: %s", gPrefix, redactPassword(err.Error()))
+		}
+	}
+	params, err := parseDSN(dsn)
+	if err != nil {
+		return "", fmt.Errorf("invalid %sCONN connect string: %s", gPrefix, redactPassword(err.Error()))
+	}
+	value := func(key, envKey, def string) string {
+		v, ok := params[key]
+		if ok && v != "" {
+			return v
+		}
+		v = os.Getenv(envKey)
+		if v != "" {
+			return v
+		}
+		return def
+	}
+	host := value("host", "PGHOST", "localhost")
+	port := value("port", "PGPORT", "5432")
+	user := value("user", "PGUSER", os.Getenv("USER"))
+	return fmt.Sprintf("%s:%s as %s", host, port, user), nil
+}
+
+// connString returns V3_CONN with SSL options from V3_SSL_* variables appended
+// it supports both URL (postgres://...) and key=value connect strings
+func connString(env map[string]string) (string, error) {
+	connStr, _ := env["CONN"]
+	sslMode, _ := env["SSL_MODE"]
+	switch sslMode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		return "", fmt.Errorf("unknown %sSSL_MODE: '%s', allowed values are: disable, require, verify-ca, verify-full", gPrefix, sslMode)
+	}
+	params := [][2]string{}
+	if sslMode != "" {
+		params = append(params, [2]string{"sslmode", sslMode})
+	}
+	for _, item := range [][2]string{{"SSL_ROOT_CERT", "sslrootcert"}, {"SSL_CERT", "sslcert"}, {"SSL_KEY", "sslkey"}} {
+		fn, _ := env[item[0]]
+		if fn == "" {
+			continue
+		}
+		_, err := os.Stat(fn)
+		if err != nil {
+			return "", fmt.Errorf("%s%s file '%s' cannot be used: %+v", gPrefix, item[0], fn, err)
+		}
+		params = append(params, [2]string{item[1], fn})
+	}
+	rootCert, _ := env["SSL_ROOT_CERT"]
+	if (sslMode == "verify-ca" || sslMode == "verify-full") && rootCert == "" {
+		return "", fmt.Errorf("%sSSL_MODE=%s requires %sSSL_ROOT_CERT", gPrefix, sslMode, gPrefix)
+	}
+	cert, _ := env["SSL_CERT"]
+	key, _ := env["SSL_KEY"]
+	if (cert == "") != (key == "") {
+		return "", fmt.Errorf("%sSSL_CERT and %sSSL_KEY must be specified together", gPrefix, gPrefix)
+	}
+	if len(params) == 0 {
+		return connStr, nil
+	}
+	if strings.Contains(connStr, "://") {
+		values := url.Values{}
+		for _, param := range params {
+			values.Set(param[0], param[1])
+		}
+		sep := "?"
+		if strings.Contains(connStr, "?") {
+			sep = "&"
+		}
+		return connStr + sep + values.Encode(), nil
+	}
+	for _, param := range params {
+		value := strings.Replace(strings.Replace(param[1], `\`, `\\`, -1), "'", `\'`, -1)
+		connStr += fmt.Sprintf(" %s='%s'", param[0], value)
+	}
+	return strings.TrimSpace(connStr), nil
+}
+
+func calcMetric() error {
+	env := make(map[string]string)
+	prefixLen := len(gPrefix)
+	for _, pair := range os.Environ() {
+		if strings.HasPrefix(pair, gPrefix) {
+			ary := strings.Split(pair, "=")
+			if len(ary) < 2 {
+				continue
+			}
+			key := ary[0]
+			val := strings.Join(ary[1:], "=")
+			env[key[prefixLen:]] = val
+		}
+	}
+	timeFormat, _ := env["TIME_FORMAT"]
+	if timeFormat != "" {
+		lib.LogTimeLayout = lib.TimeLayout(timeFormat)
+	}
+	_, printDDL := env["PRINT_DDL"]
+	_, printOnlySQL := env["PRINT_SQL"]
+	// in print and JSON output modes only SQL/DDL/JSON goes to the standard output
+	output, _ := env["OUTPUT"]
+	if printDDL || printOnlySQL || strings.Contains(output, "json") {
+		lib.LogOutput = os.Stderr
+	}
+	_, debug := env["DEBUG"]
+	if debug {
+		lib.Logf("map: %+v\n", env)
+	}
+	// in daemon and listen modes required variables can be provided by each calculation request
+	err := checkConflicts(env)
+	if err != nil {
+		return err
+	}
+	daemon, _ := env["DAEMON"]
+	listen, _ := env["LISTEN"]
+	_, checkOnly := env["CHECK_ONLY"]
+	if (daemon == "" && listen == "") || checkOnly {
+		err = checkRequired(env)
+		if err != nil {
+			return err
+		}
+		err = assertSQLHash(env)
+		if err != nil {
+			return err
+		}
+	}
+	if printOnlySQL {
+		return printSQL(debug, env)
+	}
+	gTracer, err = newTracer(env)
+	if err != nil {
+		return err
+	}
+	err = startJitter(env)
+	if err != nil {
+		return err
+	}
+	// with empty connect string lib/pq uses standard PGHOST, PGUSER, PGPASSWORD, PGDATABASE etc. environment variables
+	connStr, err := connString(env)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return err
+	}
+	defer func() { db.Close() }()
+	if debug {
+		lib.Logf("db: %+v\n", db)
+	}
+	target, err := connTarget(connStr)
+	if err != nil {
+		return err
+	}
+	err = db.Ping()
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %+v", target, err)
+	}
+	if checkOnly {
+		return checkSetup(env)
+	}
+	if daemon != "" || listen != "" {
+		errs := make(chan error, 2)
+		if daemon != "" {
+			go func() { errs <- serveDaemon(db, daemon, debug, env) }()
+		}
+		if listen != "" {
+			go func() { errs <- listenNotify(db, connStr, listen, debug, env) }()
+		}
+		return <-errs
+	}
+	return runMetrics(db, debug, env)
+}
+
+// metricsList returns metrics to calculate from V3_METRIC which can be comma separated
+func metricsList(env map[string]string) []string {
+	metric, _ := env["METRIC"]
+	metrics := []string{}
+	for _, m := range strings.Split(metric, ",") {
+		m = strings.TrimSpace(m)
+		if m != "" {
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
+
+// resetSQLCache forgets files fetched from http(s) V3_SQL_PATH, so each run (or daemon/listen request) fetches them again
+func resetSQLCache() {
+	gSQLCacheMtx.Lock()
+	gSQLCache = make(map[string][]byte)
+	gSQLCacheMtx.Unlock()
+}
+
+// runMetrics calculates all metrics from V3_METRIC one after another
+// by default first failing metric stops the run, with V3_CONTINUE_ON_ERROR remaining metrics are still calculated
+// and an error listing all failed metrics is returned at the end
+func runMetrics(db *sql.DB, debug bool, env map[string]string) error {
+	resetSQLCache()
+	metrics := metricsList(env)
+	if len(metrics) <= 1 {
+		return runMetric(db, debug, env)
+	}
+	_, continueOnError := env["CONTINUE_ON_ERROR"]
+	succeeded, failed := []string{}, []string{}
+	for i, metric := range metrics {
+		lib.Logf("metric %d/%d: %s\n", i+1, len(metrics), metric)
+		metricEnv := make(map[string]string)
+		for k, v := range env {
+			metricEnv[k] = v
+		}
+		metricEnv["METRIC"] = metric
+		// table shared by all metrics is only dropped before the first one
+		table, _ := env["TABLE"]
+		if i > 0 && !strings.Contains(table, "{{metric}}") {
+			delete(metricEnv, "DROP")
+		}
+		err := runMetric(db, debug, metricEnv)
+		if err != nil {
+			if !continueOnError {
+				return fmt.Errorf("metric '%s': %+v", metric, err)
+			}
+			lib.Logf("metric '%s' error: %+v\n", metric, err)
+			failed = append(failed, metric)
+			continue
+		}
+		succeeded = append(succeeded, metric)
+	}
+	lib.Logf("metrics succeeded (%d): %s\n", len(succeeded), strings.Join(succeeded, ", "))
+	if len(failed) > 0 {
+		lib.Logf("metrics failed (%d): %s\n", len(failed), strings.Join(failed, ", "))
+		return fmt.Errorf("%d of %d metrics failed: %s", len(failed), len(metrics), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// startJitter sleeps a random duration from V3_START_JITTER range (like 0-120s or 2m) before connecting
+// so many jobs started at the same time don't hit the database at once, it can be interrupted with Ctrl-C
+func startJitter(env map[string]string) error {
+	jitter, _ := env["START_JITTER"]
+	if jitter == "" {
+		return nil
+	}
+	minStr, maxStr := "0", jitter
+	ary := strings.Split(jitter, "-")
+	if len(ary) == 2 {
+		minStr, maxStr = ary[0], ary[1]
+	}
+	maxD, err := time.ParseDuration(maxStr)
+	if err != nil {
+		return fmt.Errorf("invalid %sSTART_JITTER '%s': %+v", gPrefix, jitter, err)
+	}
+	minD, err := time.ParseDuration(minStr)
+	if err != nil {
+		// min without unit uses max's unit, for example 30-120s
+		minD, err = time.ParseDuration(minStr + strings.TrimLeft(maxStr, "0123456789."))
+		if err != nil {
+			return fmt.Errorf("invalid %sSTART_JITTER '%s': %+v", gPrefix, jitter, err)
+		}
+	}
+	if maxD < minD {
+		return fmt.Errorf("invalid %sSTART_JITTER '%s': maximum is less than minimum", gPrefix, jitter)
+	}
+	delay := minD
+	if maxD > minD {
+		delay += time.Duration(rand.Int63n(int64(maxD - minD)))
+	}
+	lib.Logf("start jitter: sleeping %v\n", delay)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("interrupted during start jitter")
+	}
+}
+
+// outputs holds enabled output targets
+type outputs struct {
+	toDB      bool
+	matview   bool
+	toKafka   bool
+	toJSON    bool
+	toParquet bool
+}
+
+// stateless returns true when results are not stored anywhere where calculation state can be checked,
+// so every run calculates (JSON only output)
+func (o outputs) stateless() bool {
+	return o.toJSON && !o.toDB && !o.toKafka && !o.toParquet
+}
+
+// outputTargets returns output targets from V3_OUTPUT comma separated list: table (or db), matview, kafka, json and parquet
+// default is table, matview cannot be combined with other outputs
+func outputTargets(env map[string]string) (outputs, error) {
+	output, _ := env["OUTPUT"]
+	if output == "" {
+		return outputs{toDB: true}, nil
+	}
+	out := outputs{}
+	for _, item := range strings.Split(output, ",") {
+		switch strings.TrimSpace(item) {
+		case "table", "db":
+			out.toDB = true
+		case "matview":
+			out.matview = true
+		case "kafka":
+			out.toKafka = true
+		case "json":
+			out.toJSON = true
+		case "parquet":
+			out.toParquet = true
+		default:
+			return outputs{}, fmt.Errorf("unknown output: '%s', allowed values are: table, matview, kafka, json, parquet", item)
+		}
+	}
+	if out.matview && (out.toDB || out.toKafka || out.toJSON || out.toParquet) {
+		return outputs{}, fmt.Errorf("matview output cannot be combined with other outputs")
+	}
+	// without a table calculation state can only be kept in the state table, otherwise every run would publish the same window again
+	stateTable, _ := env["STATE_TABLE"]
+	if (out.toKafka || out.toParquet) && !out.toDB && stateTable == "" {
+		return outputs{}, fmt.Errorf("kafka and parquet outputs without table output require %sSTATE_TABLE", gPrefix)
+	}
+	return out, nil
+}
+
+// jsonRows streams calculated rows of all calculations in a run as a single JSON array (V3_OUTPUT=json)
+type jsonRows struct {
+	mtx     sync.Mutex
+	w       io.Writer
+	started bool
+}
+
+// jsonValue converts a value bound for a metric column of dbType to JSON value, numbers and booleans
+// scanned as strings become JSON numbers and booleans
+func jsonValue(value interface{}, dbType string) interface{} {
+	str, ok := value.(string)
+	if !ok {
+		return value
+	}
+	switch dbType {
+	case "int2", "int4", "int8", "numeric", "float4", "float8":
+		if str == "" {
+			return nil
+		}
+		return json.Number(str)
+	case "bool":
+		switch str {
+		case "t", "true":
+			return true
+		case "f", "false":
+			return false
+		default:
+			return nil
+		}
+	}
+	return value
+}
+
+// jsonColumnTypes returns types of JSON row values: nSynth untyped synthetic columns, metric SQL columns
+// and computed percentile and percent of total columns (when present, in that order)
+func jsonColumnTypes(nSynth int, dbTypes []string, percentile, pctOfTotal bool) []string {
+	types := make([]string, nSynth)
+	types = append(types, dbTypes...)
+	if percentile {
+		types = append(types, "float8")
+	}
+	if pctOfTotal {
+		types = append(types, "float8")
+	}
+	return types
+}
+
+// write writes a single row, values are in names order
+func (jr *jsonRows) write(names, types []string, values []interface{}) error {
+	row := make(map[string]interface{})
+	for i, name := range names {
+		row[name] = jsonValue(values[i], types[i])
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	jr.mtx.Lock()
+	defer jr.mtx.Unlock()
+	sep := ",\n"
+	if !jr.started {
+		sep = "[\n"
+		jr.started = true
+	}
+	_, err = fmt.Fprintf(jr.w, "%s%s", sep, data)
+	return err
+}
+
+// close finishes the JSON array (empty array when there were no rows)
+func (jr *jsonRows) close() {
+	if jr == nil {
+		return
+	}
+	jr.mtx.Lock()
+	defer jr.mtx.Unlock()
+	if !jr.started {
+		fmt.Fprintf(jr.w, "[]\n")
+		return
+	}
+	fmt.Fprintf(jr.w, "\n]\n")
+}
+
+// s3Key returns V3_S3_KEY with {{metric}}, {{project_slug}}, {{time_range}}, {{date_from}} and {{date_to}} placeholders replaced
+func s3Key(projectSlug, timeRange, dtFrom, dtTo string, env map[string]string) (string, error) {
+	bucket, _ := env["S3_BUCKET"]
+	key, _ := env["S3_KEY"]
+	if bucket == "" || key == "" {
+		return "", fmt.Errorf("you must specify %sS3_BUCKET and %sS3_KEY for parquet output", gPrefix, gPrefix)
+	}
+	metric, _ := env["METRIC"]
+	replacer := strings.NewReplacer(
+		"{{metric}}", metric,
+		"{{project_slug}}", projectSlug,
+		"{{time_range}}", timeRange,
+		"{{date_from}}", dtFrom,
+		"{{date_to}}", dtTo,
+	)
+	return strings.TrimLeft(replacer.Replace(key), "/"), nil
+}
+
+// s3Put uploads data to V3_S3_BUCKET using AWS signature version 4, credentials are taken from standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables
+// region is V3_S3_REGION (or AWS_REGION, default us-east-1), V3_S3_ENDPOINT can point to S3 compatible storage (path style)
+func s3Put(key string, data []byte, contentType string, env map[string]string) error {
+	bucket, _ := env["S3_BUCKET"]
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for parquet output")
+	}
+	region, _ := env["S3_REGION"]
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	// signature version 4 canonical URI has everything but unreserved characters percent encoded
+	escape := func(segment string) string {
+		escaped := ""
+		for _, c := range []byte(segment) {
+			if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' {
+				escaped += string(c)
+			} else {
+				escaped += fmt.Sprintf("%%%02X", c)
+			}
+		}
+		return escaped
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	path := "/" + strings.Join(segments, "/")
+	host := fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, region)
+	scheme := "https"
+	endpoint, _ := env["S3_ENDPOINT"]
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid %sS3_ENDPOINT '%s': %+v", gPrefix, endpoint, err)
 		}
-	case "y", "yp":
-		_, daily := env["CALC_YEAR_DAILY"]
-		if daily {
-			dtt = lib.DayStart(now)
-			dtf = dtt.AddDate(-1, 0, 0)
-			if timeRange == "yp" {
-				dtf = dtf.AddDate(-1, 0, 0)
-				dtt = dtt.AddDate(-1, 0, 0)
+		scheme, host = u.Scheme, u.Host
+		path = "/" + escape(bucket) + path
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256.Sum256(data)
+	headers := map[string]string{
+		"content-type":         contentType,
+		"host":                 host,
+		"x-amz-content-sha256": hex.EncodeToString(payloadHash[:]),
+		"x-amz-date":           amzDate,
+	}
+	token := os.Getenv("AWS_SESSION_TOKEN")
+	if token != "" {
+		headers["x-amz-security-token"] = token
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{"PUT", path, "", canonicalHeaders, signedHeaders, headers["x-amz-content-sha256"]}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		_, _ = h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	signingKey := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req, err := http.NewRequest(http.MethodPut, scheme+"://"+host+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("S3 upload of s3://%s/%s failed: %s: %s", bucket, key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// newKafkaWriter returns Kafka writer for V3_KAFKA_BROKERS (comma separated) and V3_KAFKA_TOPIC
+func newKafkaWriter(env map[string]string) (*kafka.Writer, error) {
+	brokers, _ := env["KAFKA_BROKERS"]
+	topic, _ := env["KAFKA_TOPIC"]
+	if brokers == "" || topic == "" {
+		return nil, fmt.Errorf("you must specify %sKAFKA_BROKERS and %sKAFKA_TOPIC for kafka output", gPrefix, gPrefix)
+	}
+	addrs := []string{}
+	for _, broker := range strings.Split(brokers, ",") {
+		addrs = append(addrs, strings.TrimSpace(broker))
+	}
+	return &kafka.Writer{
+		Addr:         kafka.TCP(addrs...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}, nil
+}
+
+// produceRows produces rows from args (each having len(names) values) as JSON objects to Kafka
+// message key is calculation key with row number, so all updates of a given row go to the same partition
+func produceRows(writer *kafka.Writer, names []string, args []interface{}, debug bool) error {
+	n := len(names)
+	msgs := []kafka.Message{}
+	for r := 0; r+n <= len(args); r += n {
+		row := make(map[string]interface{})
+		for j, name := range names {
+			row[name] = args[r+j]
+		}
+		value, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%v/%v/%v/%v/%v", row["time_range"], row["project_slug"], row["date_from"], row["date_to"], row["row_number"])
+		msgs = append(msgs, kafka.Message{Key: []byte(key), Value: value})
+	}
+	if debug {
+		lib.Logf("producing %d messages to kafka topic '%s'\n", len(msgs), writer.Topic)
+	}
+	return writer.WriteMessages(context.Background(), msgs...)
+}
+
+// checkSetup checks if SQL path exists and metric (and summary) SQL files are readable (V3_CHECK_ONLY mode)
+// connection and required variables are checked before calling this
+func checkSetup(env map[string]string) error {
+	path := sqlPath(env)
+	if !isURL(path) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("%sSQL_PATH '%s' cannot be used: %+v", gPrefix, path, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%sSQL_PATH '%s' is not a directory", gPrefix, path)
+		}
+	}
+	files := metricsList(env)
+	for _, key := range []string{"SUMMARY_METRIC", "METRIC_SUBTRACT"} {
+		file, _ := env[key]
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	for _, file := range files {
+		_, err := readMetricSQL(env, file)
+		if err != nil {
+			return err
+		}
+	}
+	lib.Logf("check: connection, required variables and SQL files are OK\n")
+	// report success (exit code 0) instead of "no calculation needed"
+	setFinalState(lib.StateCalculated)
+	return nil
+}
+
+// checkConflicts checks that no two mutually exclusive variables from gConflictingFlags are set together
+func checkConflicts(env map[string]string) error {
+	for _, conflict := range gConflictingFlags {
+		_, ok1 := env[conflict[0]]
+		_, ok2 := env[conflict[1]]
+		if ok1 && ok2 {
+			return fmt.Errorf("%s%s cannot be used with %s%s: %s", gPrefix, conflict[0], gPrefix, conflict[1], conflict[2])
+		}
+	}
+	return nil
+}
+
+// checkRequired checks if all required variables are defined
+func checkRequired(env map[string]string) error {
+	for _, key := range gRequired {
+		_, ok := env[key]
+		if !ok && key == "PROJECT_SLUG" {
+			_, ok = env["PROJECT_SLUGS"]
+			if !ok {
+				_, ok = env["PROJECTS_SQL"]
 			}
-		} else {
-			dtt = lib.YearStart(now)
-			dtf = dtt.AddDate(-1, 0, 0)
-			if timeRange == "yp" {
-				dtf = dtf.AddDate(-1, 0, 0)
-				dtt = dtt.AddDate(-1, 0, 0)
+		}
+		if !ok {
+			err := &lib.ErrMissingEnv{Name: gPrefix + key}
+			lib.Logf("env: %s\n", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// calcRequest is a daemon mode calculation request, env keys are V3_ variables (prefix is optional)
+// limited to gRequestEnv and params are V3_PARAM_ values (without the prefix) limited to params defined by the daemon
+type calcRequest struct {
+	Metric      string            `json:"metric"`
+	ProjectSlug string            `json:"project_slug"`
+	TimeRange   string            `json:"time_range"`
+	Params      map[string]string `json:"params"`
+	Env         map[string]string `json:"env"`
+}
+
+// calcResponse is a daemon mode calculation response, state is the same as final state of a single calculation
+type calcResponse struct {
+	State int    `json:"state"`
+	Error string `json:"error,omitempty"`
+	Time  string `json:"time"`
+}
+
+// requestEnv returns a copy of daemon's environment with values from the calculation request applied
+// request can only override variables from gRequestEnv, anything else (SQL path, session SQL, drop/delete etc.) is an error
+// params are substituted as SQL text, so only params already defined by the daemon (V3_PARAM_name) can be overridden
+func requestEnv(env map[string]string, req *calcRequest) (map[string]string, error) {
+	reqEnv := make(map[string]string)
+	for k, v := range env {
+		reqEnv[k] = v
+	}
+	delete(reqEnv, "DAEMON")
+	delete(reqEnv, "DAEMON_TOKEN")
+	delete(reqEnv, "LISTEN")
+	for k, v := range req.Env {
+		key := strings.TrimPrefix(k, gPrefix)
+		_, ok := gRequestEnv[key]
+		if !ok {
+			return nil, fmt.Errorf("%s%s cannot be set by a calculation request", gPrefix, key)
+		}
+		reqEnv[key] = v
+	}
+	for k, v := range map[string]string{"METRIC": req.Metric, "PROJECT_SLUG": req.ProjectSlug, "TIME_RANGE": req.TimeRange} {
+		if v != "" {
+			reqEnv[k] = v
+		}
+	}
+	for k, v := range req.Params {
+		_, ok := env["PARAM_"+k]
+		if !ok || strings.HasPrefix(k, "FILE_") {
+			return nil, fmt.Errorf("%sPARAM_%s cannot be set by a calculation request, only params defined by the daemon can", gPrefix, k)
+		}
+		reqEnv["PARAM_"+k] = v
+	}
+	return reqEnv, nil
+}
+
+// daemonAddr returns address to listen on, without V3_DAEMON_TOKEN only loopback addresses are allowed
+// and address without host (like :8080) listens on 127.0.0.1
+func daemonAddr(addr, token string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", &lib.ErrParse{What: gPrefix + "DAEMON", Err: err}
+	}
+	if token != "" {
+		return addr, nil
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("%sDAEMON listening on '%s' requires %sDAEMON_TOKEN", gPrefix, host, gPrefix)
+	}
+	return addr, nil
+}
+
+// authorized checks Authorization: Bearer <V3_DAEMON_TOKEN> header, any request is authorized when token is not set
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	return hmac.Equal([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token))
+}
+
+// processRequest runs a single daemon/listen mode calculation request
+// requests are processed one at a time, because they share the final state
+func processRequest(db *sql.DB, env map[string]string, req *calcRequest) calcResponse {
+	reqEnv, err := requestEnv(env, req)
+	if err == nil {
+		err = checkRequired(reqEnv)
+	}
+	if err != nil {
+		lib.Logf("request %+v: %+v\n", req, err)
+		return calcResponse{State: lib.StateError, Error: err.Error()}
+	}
+	gCalcMtx.Lock()
+	defer gCalcMtx.Unlock()
+	dtStart := time.Now()
+	setFinalState(lib.StateNoop)
+	resetSQLCache()
+	_, reqDebug := reqEnv["DEBUG"]
+	lib.Logf("calculating %s/%s/%s\n", reqEnv["METRIC"], reqEnv["PROJECT_SLUG"], reqEnv["TIME_RANGE"])
+	err = runMetric(db, reqDebug, reqEnv)
+	resp := calcResponse{State: finalState(), Time: time.Now().Sub(dtStart).String()}
+	if err != nil {
+		resp.State = lib.StateError
+		resp.Error = err.Error()
+	}
+	lib.Logf("%s/%s/%s: %+v\n", reqEnv["METRIC"], reqEnv["PROJECT_SLUG"], reqEnv["TIME_RANGE"], resp)
+	return resp
+}
+
+// listenNotify listens on a Postgres notification channel and calculates metric on each notification
+// payload can be empty (use V3_ variables) or calcRequest JSON (for example to target a given project_slug/time_range)
+// LISTEN requires a dedicated (not pooled) connection, so pq.Listener is used
+func listenNotify(db *sql.DB, connStr, channel string, debug bool, env map[string]string) error {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			lib.Logf("listen: event %d: %+v\n", ev, err)
+		}
+	})
+	defer func() { _ = listener.Close() }()
+	err := listener.Listen(channel)
+	if err != nil {
+		return err
+	}
+	lib.Logf("listen: waiting for notifications on '%s'\n", channel)
+	for {
+		select {
+		case n := <-listener.Notify:
+			// nil notification is sent after reconnect, notifications could be lost, so recalculate
+			var req calcRequest
+			if n != nil && n.Extra != "" {
+				err = json.Unmarshal([]byte(n.Extra), &req)
+				if err != nil {
+					lib.Logf("listen: cannot parse notification payload '%s': %+v\n", n.Extra, err)
+					continue
+				}
+			}
+			if debug {
+				lib.Logf("listen: notification %+v\n", n)
 			}
+			_ = processRequest(db, env, &req)
+		case <-time.After(time.Minute):
+			go func() { _ = listener.Ping() }()
+		}
+	}
+}
+
+// serveDaemon serves calculation requests (POST /calculate with calcRequest JSON) using a persistent connection pool
+func serveDaemon(db *sql.DB, addr string, debug bool, env map[string]string) error {
+	token, _ := env["DAEMON_TOKEN"]
+	addr, err := daemonAddr(addr, token)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK\n"))
+	})
+	mux.HandleFunc("/calculate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req calcRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cannot parse request: %+v", err), http.StatusBadRequest)
+			return
+		}
+		reqEnv, err := requestEnv(env, &req)
+		if err == nil {
+			err = checkRequired(reqEnv)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := processRequest(db, env, &req)
+		status := http.StatusOK
+		if resp.State < 0 {
+			status = http.StatusInternalServerError
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		// calculations can take long, response is written after the calculation
+		WriteTimeout: 2 * time.Hour,
+		IdleTimeout:  2 * time.Minute,
+	}
+	lib.Logf("daemon: listening on %s\n", addr)
+	return srv.ListenAndServe()
+}
+
+// prepareEnv validates time related options and loads params from V3_PARAM_FILE_ files and metric params file
+func prepareEnv(env map[string]string, debug bool) error {
+	_, err := nowTime(env)
+	if err != nil {
+		return err
+	}
+	_, err = prevMode(env)
+	if err != nil {
+		return err
+	}
+	_, err = ytdPrevMode(env)
+	if err != nil {
+		return err
+	}
+	_, _, err = expectedRows(env)
+	if err != nil {
+		return err
+	}
+	err = checkTimeouts(env)
+	if err != nil {
+		return err
+	}
+	_, _, err = rowNumberOptions(env)
+	if err != nil {
+		return err
+	}
+	err = loadParamFiles(env)
+	if err != nil {
+		return err
+	}
+	err = loadMetricParams(env, debug)
+	if err != nil {
+		return err
+	}
+	_, exclusive := env["DATE_TO_EXCLUSIVE"]
+	if inclusiveDateTo(env) {
+		lib.Logf("%sDATE_TO_EXCLUSIVE: %sDATE_TO/%sDATES date_to (also stored date_to) is the last included day, {{date_to}} in SQL is the next day (use '< {{date_to}}')\n", gPrefix, gPrefix, gPrefix)
+	} else if exclusive {
+		lib.Logf("%sDATE_TO_EXCLUSIVE only applies to c and list time ranges, other time ranges already have an exclusive date_to, it is ignored\n", gPrefix)
+	} else if debug {
+		lib.Logf("{{date_to}} in SQL is the same as stored date_to (exclusive upper bound, use '< {{date_to}}')\n")
+	}
+	return nil
+}
+
+// timeRangeWindows returns all date_from - date_to windows calculated for a given V3_TIME_RANGE
+// and time range stored for them ("c" for list and range modes)
+func timeRangeWindows(timeRange string, debug bool, env map[string]string) ([][2]time.Time, string, error) {
+	switch timeRange {
+	case "list":
+		windows, err := listWindows(env)
+		return windows, "c", err
+	case "range":
+		windows, err := backfillWindows(env)
+		return windows, "c", err
+	default:
+		dtf, dtt, err := timeRangeDates(timeRange, debug, env)
+		return [][2]time.Time{{dtf, dtt}}, timeRange, err
+	}
+}
+
+// baseTableSQL returns base table name and SQL creating it from V3_BASE_SQL file, empty SQL when V3_BASE_SQL is not set
+// base SQL is rendered once for all windows: {{date_from}} is the earliest window start and {{date_to}} is the latest window end
+// suffix is appended to the base table name, so concurrent runs don't share it
+func baseTableSQL(table, projectSlug, suffix string, windows [][2]time.Time, env map[string]string) (string, string, error) {
+	base, _ := env["BASE_SQL"]
+	if base == "" || len(windows) == 0 {
+		return "", "", nil
+	}
+	contents, err := includeSQL(env, base, []string{})
+	if err != nil {
+		return "", "", err
+	}
+	dtf, dtt := windows[0][0], windows[0][1]
+	for _, window := range windows[1:] {
+		if window[0].Before(dtf) {
+			dtf = window[0]
+		}
+		if window[1].After(dtt) {
+			dtt = window[1]
+		}
+	}
+	sql := trimSQL(renderSQL(contents, projectSlug, dtf, dtt, env))
+	err = checkPlaceholders(sql)
+	if err != nil {
+		return "", "", err
+	}
+	baseTable := table + "_base_" + toDBIdentifier(projectSlug) + suffix
+	return baseTable, fmt.Sprintf("create unlogged table \"%s\" as\n%s", baseTable, sql), nil
+}
+
+// baseEnv returns copy of env with {{base_table}} placeholder pointing to the base table
+func baseEnv(baseTable string, env map[string]string) map[string]string {
+	newEnv := make(map[string]string)
+	for k, v := range env {
+		newEnv[k] = v
+	}
+	newEnv["PARAM_base_table"] = `"` + baseTable + `"`
+	return newEnv
+}
+
+// lazyTable creates a table on the first ensure call, it is safe for concurrent use
+type lazyTable struct {
+	once    sync.Once
+	create  func() error
+	err     error
+	created bool
+}
+
+// ensure creates the table unless it was already created, returns the creation error
+func (lt *lazyTable) ensure() error {
+	lt.once.Do(func() {
+		lt.err = lt.create()
+		lt.created = lt.err == nil
+	})
+	return lt.err
+}
+
+// ensureBaseTable creates V3_BASE_SQL base table referenced by env (if any) when it wasn't created yet
+func ensureBaseTable(env map[string]string) error {
+	baseTable, ok := env["PARAM_base_table"]
+	if !ok {
+		return nil
+	}
+	gBaseTablesMtx.Lock()
+	lt, ok := gBaseTables[baseTable]
+	gBaseTablesMtx.Unlock()
+	if !ok {
+		return nil
+	}
+	return lt.ensure()
+}
+
+// createBaseTable prepares V3_BASE_SQL to run once for all windows of a project into a scratch table, so metric SQL
+// can aggregate it per window using {{base_table}} instead of scanning the source data for each window
+// base table is created by ensureBaseTable on the first window that needs calculation, so nothing is scanned
+// when all windows are already calculated, its name has a random suffix, so concurrent runs don't collide
+// returns env to use for calculations and a function dropping the base table
+func createBaseTable(db *sql.DB, table, projectSlug string, debug bool, env map[string]string) (map[string]string, func(), error) {
+	noop := func() {}
+	base, _ := env["BASE_SQL"]
+	_, maintenanceOnly := env["MAINTENANCE_ONLY"]
+	if base == "" || maintenanceOnly {
+		return env, noop, nil
+	}
+	out, err := outputTargets(env)
+	if err != nil {
+		return nil, noop, err
+	}
+	if out.matview {
+		return nil, noop, fmt.Errorf("%sBASE_SQL cannot be used with materialized view output, base table is dropped after calculation", gPrefix)
+	}
+	timeRange, _ := env["TIME_RANGE"]
+	windows, _, err := timeRangeWindows(timeRange, debug, env)
+	if err != nil {
+		return nil, noop, err
+	}
+	baseTable, baseSQL, err := baseTableSQL(table, projectSlug, "_"+randomHex(4), windows, env)
+	if err != nil {
+		return nil, noop, err
+	}
+	lt := &lazyTable{}
+	lt.create = func() error {
+		if debug {
+			lib.Logf("base SQL:\n%s\n", baseSQL)
+		}
+		dtStart := time.Now()
+		res, err := db.Exec(baseSQL)
+		if err != nil {
+			lib.QueryOut(baseSQL, []interface{}{}...)
+			return err
+		}
+		rows, _ := res.RowsAffected()
+		lib.Logf("base table '%s' created with %d rows for %d windows in %v\n", baseTable, rows, len(windows), time.Since(dtStart))
+		query := fmt.Sprintf(`analyze "%s"`, baseTable)
+		_, err = db.Exec(query)
+		if err != nil {
+			lib.QueryOut(query, []interface{}{}...)
+			return err
 		}
-	case "2y", "2yp":
-		_, daily := env["CALC_YEAR2_DAILY"]
-		if daily {
-			dtt = lib.DayStart(now)
-			dtf = dtt.AddDate(-2, 0, 0)
-			if timeRange == "2yp" {
-				dtf = dtf.AddDate(-2, 0, 0)
-				dtt = dtt.AddDate(-2, 0, 0)
-			}
-		} else {
-			dtt = lib.YearStart(now)
-			if now.Year()%2 == 1 {
-				dtt = dtt.AddDate(-1, 0, 0)
-			}
-			dtf = dtt.AddDate(-2, 0, 0)
-			if timeRange == "2yp" {
-				dtf = dtf.AddDate(-2, 0, 0)
-				dtt = dtt.AddDate(-2, 0, 0)
-			}
+		return nil
+	}
+	projectEnv := baseEnv(baseTable, env)
+	key := projectEnv["PARAM_base_table"]
+	gBaseTablesMtx.Lock()
+	gBaseTables[key] = lt
+	gBaseTablesMtx.Unlock()
+	drop := func() {
+		gBaseTablesMtx.Lock()
+		delete(gBaseTables, key)
+		gBaseTablesMtx.Unlock()
+		// table can also exist when creation failed after the create table statement (for example in analyze)
+		if !lt.created && lt.err == nil {
+			return
 		}
-	case "a":
-		dtt, _ = lib.TimeParseAny("2100")
-		dtf, _ = lib.TimeParseAny("1970")
-		if timeRange == "typ" {
-			diff := dtt.Sub(dtf)
-			dtf = dtf.Add(-diff)
-			dtt = dtt.Add(-diff)
+		query := fmt.Sprintf(`drop table if exists "%s"`, baseTable)
+		_, err := db.Exec(query)
+		if err != nil {
+			lib.Logf("error dropping base table: %+v\n", err)
+			lib.QueryOut(query, []interface{}{}...)
 		}
 	}
-	lib.Logf("checking for time range %s - %s\n", lib.ToYMDQuoted(dtf), lib.ToYMDQuoted(dtt))
-	return dtf, dtt
+	return projectEnv, drop, nil
 }
 
-func needsCalculation(db *sql.DB, table, projectSlug, timeRange string, debug bool, env map[string]string) (bool, time.Time, time.Time, error) {
-	var tm time.Time
-	switch timeRange {
-	case "7d", "7dp", "30d", "30dp", "q", "qp", "ty", "typ", "y", "yp", "2y", "2yp", "a":
-		dtf, dtt := currentTimeRange(timeRange, debug, env)
-		isCalc, err := isCalculated(db, table, projectSlug, timeRange, debug, env, dtf, dtt)
-		if err != nil {
-			return true, dtf, dtt, err
+// printSQL prints fully substituted metric (and summary) SQL for all projects and windows without connecting to the database (V3_PRINT_SQL)
+func printSQL(debug bool, env map[string]string) error {
+	for _, metric := range metricsList(env) {
+		metricEnv := make(map[string]string)
+		for k, v := range env {
+			metricEnv[k] = v
 		}
-		return !isCalc, dtf, dtt, nil
-	case "c":
-		dtFrom, ok := env["DATE_FROM"]
-		if !ok {
-			return true, tm, tm, fmt.Errorf("you must specify %sDATE_FROM when using %sTIME_RANGE=c", gPrefix, gPrefix)
+		metricEnv["METRIC"] = metric
+		err := prepareEnv(metricEnv, debug)
+		if err != nil {
+			return err
 		}
-		dtTo, ok := env["DATE_TO"]
-		if !ok {
-			return true, tm, tm, fmt.Errorf("you must specify %sDATE_TO when using %sTIME_RANGE=c", gPrefix, gPrefix)
+		projectsSQL, _ := metricEnv["PROJECTS_SQL"]
+		if projectsSQL != "" {
+			return fmt.Errorf("%sPROJECTS_SQL cannot be used with %sPRINT_SQL, it needs a database connection", gPrefix, gPrefix)
 		}
-		dtf, err := lib.TimeParseAny(dtFrom)
+		projectSlugs, err := projectsList(nil, debug, metricEnv)
 		if err != nil {
-			return true, tm, tm, err
+			return err
 		}
-		dtt, err := lib.TimeParseAny(dtTo)
+		timeRange, _ := metricEnv["TIME_RANGE"]
+		windows, sqlTimeRange, err := timeRangeWindows(timeRange, debug, metricEnv)
 		if err != nil {
-			return true, dtf, tm, err
+			return err
 		}
-		dtf = lib.DayStart(dtf)
-		dtt = lib.DayStart(dtt)
-		isCalc, err := isCalculated(db, table, projectSlug, timeRange, debug, env, dtf, dtt)
-		if err != nil {
-			return true, dtf, dtt, err
+		table, _ := metricEnv["TABLE"]
+		for _, projectSlug := range projectSlugs {
+			projectEnv := metricEnv
+			baseTable, baseSQL, err := baseTableSQL(renderTable(table, projectSlug, metricEnv), projectSlug, "", windows, metricEnv)
+			if err != nil {
+				return err
+			}
+			if baseSQL != "" {
+				fmt.Printf("-- base, project_slug: %s\n%s;\n", projectSlug, baseSQL)
+				projectEnv = baseEnv(baseTable, metricEnv)
+			}
+			for _, window := range windows {
+				sqlEnv, err := incrementalEnv(nil, "", projectSlug, sqlTimeRange, debug, projectEnv)
+				if err != nil {
+					return err
+				}
+				sql, summarySQL, err := buildSQL(projectSlug, sqlTimeRange, window[0], window[1], debug, sqlEnv)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("-- metric: %s, project_slug: %s, time_range: %s, %s - %s\n%s;\n", metric, projectSlug, timeRange, lib.ToYMD(window[0]), lib.ToYMD(window[1]), trimSQL(sql))
+				if summarySQL != "" {
+					fmt.Printf("-- summary\n%s;\n", trimSQL(summarySQL))
+				}
+			}
 		}
-		return !isCalc, dtf, dtt, nil
-	default:
-		return true, tm, tm, fmt.Errorf("unknown time range: '%s'", timeRange)
 	}
+	setFinalState(lib.StateCalculated)
+	return nil
 }
 
-func calcMetric() error {
-	env := make(map[string]string)
-	prefixLen := len(gPrefix)
-	for _, pair := range os.Environ() {
-		if strings.HasPrefix(pair, gPrefix) {
-			ary := strings.Split(pair, "=")
-			if len(ary) < 2 {
-				continue
-			}
-			key := ary[0]
-			val := strings.Join(ary[1:], "=")
-			env[key[prefixLen:]] = val
-		}
+// runMetric calculates metric specified by env using db connection pool
+func runMetric(db *sql.DB, debug bool, env map[string]string) error {
+	_, printDDL := env["PRINT_DDL"]
+	table, _ := env["TABLE"]
+	out, err := outputTargets(env)
+	if err != nil {
+		return err
 	}
-	_, debug := env["DEBUG"]
 	if debug {
-		lib.Logf("map: %+v\n", env)
+		lib.Logf("outputs: %+v\n", out)
 	}
-	for _, key := range gRequired {
-		_, ok := env[key]
-		if !ok {
-			msg := fmt.Sprintf("you must define %s%s environment variable to run this", gPrefix, key)
-			lib.Logf("env: %s\n", msg)
-			err := fmt.Errorf("%s", msg)
+	matview := out.matview
+	gMtx.Lock()
+	if out.toJSON && gJSONOut == nil {
+		gJSONOut = &jsonRows{w: os.Stdout}
+	}
+	gMtx.Unlock()
+	err = prepareEnv(env, debug)
+	if err != nil {
+		return err
+	}
+	// table name depending on the project is dropped for each project separately
+	_, drop := env["DROP"]
+	if drop && !printDDL && !strings.Contains(table, "{{project_slug}}") {
+		err := dropTable(db, renderTable(table, "", env), matview, debug, env)
+		if err != nil {
 			return err
 		}
 	}
-	connStr, _ := env["CONN"]
-	db, err := sql.Open("postgres", connStr)
+	// Per Project Tables
+	_, ppt := env["PPT"]
+	projectSlugs, err := projectsList(db, debug, env)
 	if err != nil {
 		return err
 	}
-	defer func() { db.Close() }()
+	pr, err := newProgress("projects", len(projectSlugs), 0, env)
+	if err != nil {
+		return err
+	}
+	for i, projectSlug := range projectSlugs {
+		if len(projectSlugs) > 1 {
+			lib.Logf("project %d/%d: '%s'\n", i+1, len(projectSlugs), projectSlug)
+		}
+		err = calcProject(db, table, projectSlug, ppt, matview, debug, env)
+		if err != nil {
+			return err
+		}
+		if len(projectSlugs) > 1 {
+			pr.step(1)
+		}
+	}
+	return nil
+}
+
+// dropTable drops table (or all materialized views of the table, see matviewName)
+func dropTable(db *sql.DB, table string, matview, debug bool, env map[string]string) error {
+	dropTable := fmt.Sprintf(`drop table if exists "%s"`, table)
+	if matview {
+		views, err := matviews(db, table)
+		if err != nil {
+			return err
+		}
+		if len(views) == 0 {
+			return nil
+		}
+		dropTable = fmt.Sprintf(`drop materialized view if exists "%s"`, strings.Join(views, `", "`))
+	}
+	// latest view depends on the table
+	_, latestView := env["CREATE_LATEST_VIEW"]
+	if latestView && !matview {
+		dropTable = fmt.Sprintf(`drop view if exists "%s_latest"; %s`, table, dropTable)
+	}
 	if debug {
-		lib.Logf("db: %+v\n", db)
+		lib.Logf("drop table:\n%s\n", dropTable)
 	}
-	table, _ := env["TABLE"]
-	_, drop := env["DROP"]
-	if drop {
-		dropTable := fmt.Sprintf(`drop table if exists "%s"`, table)
+	err := execDDL(db, dropTable, env)
+	if err != nil {
+		lib.QueryOut(dropTable, []interface{}{}...)
+		return err
+	}
+	_, maintenanceOnly := env["MAINTENANCE_ONLY"]
+	if maintenanceOnly {
+		setFinalState(lib.StateCalculated)
+	}
+	return nil
+}
+
+// renderTable replaces {{project_slug}}, {{time_range}} and V3_PARAM_ params in a table name
+// templated table name is then converted using toDBIdentifier, not templated name is returned as is
+func renderTable(table, projectSlug string, env map[string]string) string {
+	if !strings.Contains(table, "{{") {
+		return table
+	}
+	timeRange, _ := env["TIME_RANGE"]
+	table = strings.Replace(table, "{{project_slug}}", projectSlug, -1)
+	table = strings.Replace(table, "{{time_range}}", timeRange, -1)
+	metric, _ := env["METRIC"]
+	table = strings.Replace(table, "{{metric}}", metric, -1)
+	for k, v := range env {
+		if strings.HasPrefix(k, "PARAM_") && !strings.HasPrefix(k, "PARAM_FILE_") {
+			table = strings.Replace(table, "{{"+k[6:]+"}}", v, -1)
+		}
+	}
+	return toDBIdentifier(table)
+}
+
+// projectsList returns list of projects to calculate from V3_PROJECT_SLUGS or V3_PROJECT_SLUG, both can be comma separated
+// When V3_PROJECTS_SQL is set, projects are returned by that query (first column of each row)
+func projectsList(db *sql.DB, debug bool, env map[string]string) ([]string, error) {
+	projects := []string{}
+	projectsSQL, _ := env["PROJECTS_SQL"]
+	if projectsSQL != "" {
 		if debug {
-			lib.Logf("drop table:\n%s\n", dropTable)
+			lib.Logf("projects SQL:\n%s\n", projectsSQL)
+		}
+		rows, err := db.Query(projectsSQL)
+		if err != nil {
+			lib.QueryOut(projectsSQL, []interface{}{}...)
+			return nil, err
+		}
+		defer func() { _ = rows.Close() }()
+		projectSlug := ""
+		for rows.Next() {
+			err = rows.Scan(&projectSlug)
+			if err != nil {
+				return nil, err
+			}
+			projects = append(projects, projectSlug)
+		}
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+		lib.Logf("projects SQL returned %d projects\n", len(projects))
+		return projects, nil
+	}
+	projects, _, err := projectGroups(env)
+	if err != nil {
+		return nil, err
+	}
+	return projects, nil
+}
+
+// projectGroups parses V3_PROJECT_SLUGS or V3_PROJECT_SLUG, returns project names in order and meta projects
+// meta project is defined as name:slug1,slug2 - metric is calculated for all sub slugs ({{project_slugs}}) and stored as name
+// when any meta project is defined, entries are separated by ';' instead of ',', for example: meta1:a,b;meta2:c,d;e
+func projectGroups(env map[string]string) ([]string, map[string][]string, error) {
+	projectSlugs, ok := env["PROJECT_SLUGS"]
+	if !ok {
+		projectSlugs, _ = env["PROJECT_SLUG"]
+	}
+	sep := ","
+	if strings.Contains(projectSlugs, ":") {
+		sep = ";"
+	}
+	projects := []string{}
+	groups := make(map[string][]string)
+	for _, projectSlug := range strings.Split(projectSlugs, sep) {
+		projectSlug = strings.TrimSpace(projectSlug)
+		i := strings.Index(projectSlug, ":")
+		if i < 0 {
+			projects = append(projects, projectSlug)
+			continue
+		}
+		name := strings.TrimSpace(projectSlug[:i])
+		if name == "" {
+			return nil, nil, fmt.Errorf("%sPROJECT_SLUG meta project '%s' has no name", gPrefix, projectSlug)
 		}
-		_, err = db.Exec(dropTable)
+		_, dup := groups[name]
+		if dup {
+			return nil, nil, fmt.Errorf("%sPROJECT_SLUG meta project '%s' is defined more than once", gPrefix, name)
+		}
+		subs := []string{}
+		for _, sub := range strings.Split(projectSlug[i+1:], ",") {
+			sub = strings.TrimSpace(sub)
+			if sub != "" {
+				subs = append(subs, sub)
+			}
+		}
+		if len(subs) == 0 {
+			return nil, nil, fmt.Errorf("%sPROJECT_SLUG meta project '%s' has no project slugs", gPrefix, name)
+		}
+		groups[name] = subs
+		projects = append(projects, name)
+	}
+	return projects, groups, nil
+}
+
+// projectSlugsSQL returns quoted, comma separated sub slugs of a meta project, or the quoted project slug itself
+// it is used as {{project_slugs}}, for example: where project_slug in ({{project_slugs}})
+func projectSlugsSQL(projectSlug string, env map[string]string) string {
+	slugs := []string{projectSlug}
+	_, groups, err := projectGroups(env)
+	if err == nil {
+		subs, ok := groups[projectSlug]
+		if ok {
+			slugs = subs
+		}
+	}
+	quoted := make([]string, len(slugs))
+	for i, slug := range slugs {
+		quoted[i] = pq.QuoteLiteral(slug)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// calcProject calculates metric for a single project, using time range from V3_TIME_RANGE
+func calcProject(db *sql.DB, table, projectSlug string, ppt, matview, debug bool, env map[string]string) error {
+	_, drop := env["DROP"]
+	_, printDDL := env["PRINT_DDL"]
+	if drop && !printDDL && strings.Contains(table, "{{project_slug}}") {
+		err := dropTable(db, renderTable(table, projectSlug, env), matview, debug, env)
 		if err != nil {
-			lib.QueryOut(dropTable, []interface{}{}...)
 			return err
 		}
 	}
-	projectSlug, _ := env["PROJECT_SLUG"]
-	// Per Project Tables
-	_, ppt := env["PPT"]
+	table = renderTable(table, projectSlug, env)
 	if ppt {
 		table += "_" + toDBIdentifier(projectSlug)
 	}
-	timeRange, _ := env["TIME_RANGE"]
-	needsCalc, dtf, dtt, err := needsCalculation(db, table, projectSlug, timeRange, debug, env)
+	projectEnv, dropBase, err := createBaseTable(db, table, projectSlug, debug, env)
 	if err != nil {
 		return err
 	}
-	deleted := supportDelete(db, table, timeRange, projectSlug, dtf, dtt, debug, env)
-	if deleted {
-		needsCalc, dtf, dtt, err = needsCalculation(db, table, projectSlug, timeRange, debug, env)
+	defer dropBase()
+	err = calcWindows(db, table, projectSlug, ppt, matview, debug, projectEnv)
+	if err != nil {
+		return err
 	}
-	if !needsCalc {
-		_, ok := env["FORCE_CALC"]
-		if ok {
-			needsCalc = true
-			lib.Logf("table '%s' doesn't need calculation but it was requested to calculate anyway\n", table)
-		}
+	_, touch := env["TOUCH"]
+	out, err := outputTargets(env)
+	if err != nil {
+		return err
 	}
-	if !needsCalc {
-		if debug {
-			lib.Logf("table '%s' doesn't need calculation now\n", table)
+	if out.toDB && !printDDL && !touch {
+		return applyRetention(db, table, debug, env)
+	}
+	return nil
+}
+
+// calcWindows calculates all windows of V3_TIME_RANGE for a single project
+func calcWindows(db *sql.DB, table, projectSlug string, ppt, matview, debug bool, env map[string]string) error {
+	timeRange, _ := env["TIME_RANGE"]
+	if timeRange == "list" {
+		// Each date_from:date_to pair is calculated as a custom time range
+		windows, err := listWindows(env)
+		if err != nil {
+			return err
+		}
+		pr, err := newProgress("windows", len(windows), 0, env)
+		if err != nil {
+			return err
+		}
+		for i, window := range windows {
+			lib.Logf("calculating window %d/%d: %s - %s\n", i+1, len(windows), lib.ToYMDQuoted(window[0]), lib.ToYMDQuoted(window[1]))
+			_, err = calcRange(db, table, projectSlug, "c", window[0], window[1], ppt, matview, debug, env)
+			if err != nil {
+				return err
+			}
+			pr.step(1)
+		}
+	} else if timeRange == "range" {
+		err := backfill(db, table, projectSlug, ppt, matview, debug, env)
+		if err != nil {
+			return err
+		}
+	} else {
+		dtf, dtt, err := timeRangeDates(timeRange, debug, env)
+		if err != nil {
+			return err
+		}
+		_, err = calcRange(db, table, projectSlug, timeRange, dtf, dtt, ppt, matview, debug, env)
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// applyRetention removes rows with date_to older than now minus V3_RETENTION (Postgres interval like '1 year')
+// partitions containing only such rows are dropped as a whole
+func applyRetention(db *sql.DB, table string, debug bool, env map[string]string) error {
+	retention, _ := env["RETENTION"]
+	if retention == "" {
 		return nil
 	}
-	metric, _ := env["METRIC"]
-	path, ok := env["SQL_PATH"]
-	if !ok {
-		path = "./sql/"
+	var cutoff time.Time
+	err := db.QueryRow("select (now() - $1::interval)::date", retention).Scan(&cutoff)
+	if err != nil {
+		return err
 	}
-	fn := path + metric + ".sql"
-	contents, err := ioutil.ReadFile(fn)
+	// nothing was calculated yet
+	var exists sql.NullString
+	err = db.QueryRow("select to_regclass($1)::text", `"`+table+`"`).Scan(&exists)
 	if err != nil {
 		return err
 	}
-	sql := string(contents)
-	sql = strings.Replace(sql, "{{project_slug}}", projectSlug, -1)
-	limit, _ := env["LIMIT"]
-	if limit != "" {
-		sql = strings.Replace(sql, "{{limit}}", limit, -1)
+	if !exists.Valid {
+		lib.Logf("retention: table '%s' doesn't exist\n", table)
+		return nil
 	}
-	offset, _ := env["OFFSET"]
-	if offset != "" {
-		sql = strings.Replace(sql, "{{offset}}", offset, -1)
+	partsQuery := "select c.relname from pg_inherits i join pg_class c on c.oid = i.inhrelid where i.inhparent = $1::regclass"
+	rows, err := db.Query(partsQuery, `"`+table+`"`)
+	if err != nil {
+		lib.QueryOut(partsQuery, table)
+		return err
 	}
-	for k, v := range env {
-		if strings.HasPrefix(k, "PARAM_") {
-			n := k[6:]
-			sql = strings.Replace(sql, "{{"+n+"}}", v, -1)
+	partitions := []string{}
+	for rows.Next() {
+		partition := ""
+		err = rows.Scan(&partition)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		partitions = append(partitions, partition)
+	}
+	_ = rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	for _, partition := range partitions {
+		var maxDateTo sql.NullTime
+		query := fmt.Sprintf(`select max(date_to) from "%s"`, partition)
+		err = db.QueryRow(query).Scan(&maxDateTo)
+		if err != nil {
+			lib.QueryOut(query, []interface{}{}...)
+			return err
+		}
+		if !maxDateTo.Valid || !maxDateTo.Time.Before(cutoff) {
+			continue
+		}
+		query = fmt.Sprintf(`drop table "%s"`, partition)
+		if debug {
+			lib.Logf("retention: %s\n", query)
+		}
+		err = execDDL(db, query, env)
+		if err != nil {
+			lib.QueryOut(query, []interface{}{}...)
+			return err
 		}
+		dropped++
 	}
-	dtfs := lib.ToYMDQuoted(dtf)
-	dtts := lib.ToYMDQuoted(dtt)
-	sql = strings.Replace(sql, "{{date_from}}", dtfs, -1)
-	sql = strings.Replace(sql, "{{date_to}}", dtts, -1)
+	delQuery := fmt.Sprintf(`delete from "%s" where date_to < $1`, table)
 	if debug {
-		lib.Logf("generated SQL:\n%s\n", sql)
+		lib.Logf("retention: %s %+v\n", delQuery, cutoff)
 	}
-	err = calculate(db, sql, table, projectSlug, timeRange, dtfs, dtts, ppt, debug, env)
+	res, err := db.Exec(delQuery, cutoff)
 	if err != nil {
+		lib.QueryOut(delQuery, cutoff)
 		return err
 	}
-	supportCleanup(db, table, timeRange, projectSlug, dtf, dtt, debug, env)
+	nRows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	lib.Logf("retention: removed %d rows and %d partitions with date_to older than %s from '%s'\n", nRows, dropped, lib.ToYMDQuoted(cutoff), table)
+	// removed windows must not be reported as calculated by the state table
+	stateTable, _ := env["STATE_TABLE"]
+	if stateTable != "" && stateTable != table {
+		err = db.QueryRow("select to_regclass($1)::text", `"`+stateTable+`"`).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists.Valid {
+			mCond, mArgs := metricCond(2, env)
+			stateQuery := fmt.Sprintf(`delete from "%s" where date_to < $1%s`, stateTable, mCond)
+			args := append([]interface{}{cutoff}, mArgs...)
+			if debug {
+				lib.Logf("retention: %s %+v\n", stateQuery, args)
+			}
+			res, err = db.Exec(stateQuery, args...)
+			if err != nil {
+				lib.QueryOut(stateQuery, args...)
+				return err
+			}
+			nState, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			lib.Logf("retention: removed %d state rows with date_to older than %s from '%s'\n", nState, lib.ToYMDQuoted(cutoff), stateTable)
+		}
+	}
+	_, maintenanceOnly := env["MAINTENANCE_ONLY"]
+	if maintenanceOnly && (nRows > 0 || dropped > 0) {
+		setFinalState(lib.StateCalculated)
+	}
 	return nil
 }
 
 func main() {
 	dtStart := time.Now()
-	rCode := 0
 	err := calcMetric()
 	if err != nil {
 		lib.Logf("calcMetric error: %+v\n", err)
-		rCode = 1
-		gFinalState = -1
+		gFinalState = lib.StateError
 	}
+	gJSONOut.close()
+	gTracer.flush(err)
 	dtEnd := time.Now()
 	lib.Logf("time: %v, final state: %d\n", dtEnd.Sub(dtStart), gFinalState)
-	if rCode != 0 {
+	// lib.ExitNoop (66) marks that calculations were not needed
+	rCode := lib.ExitCode(gFinalState)
+	if rCode != lib.ExitOK {
 		os.Exit(rCode)
 	}
-	if rCode == 0 && gFinalState == 0 {
-		// This is to mark that calculations were not needed
-		os.Exit(66)
-	}
 }
@@ -0,0 +1,871 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	lib "github.com/lukaszgryglicki/calcmetric"
+)
+
+func TestMain(m *testing.M) {
+	lib.LogOutput = ioutil.Discard
+	sql.Register("fakedb", &fakeDriver{})
+	os.Exit(m.Run())
+}
+
+// ymd returns date at midnight UTC
+func ymd(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// fakeDB is an in-memory database used through the "fakedb" database/sql driver (DSN is the fakeDB name)
+// it records executed statements, keeps last_calculated_at of inserted calculation keys (so isCalculated can find them)
+// and returns metric rows for all other queries
+type fakeDB struct {
+	mtx   sync.Mutex
+	execs []fakeExec
+	// table|time_range|project_slug|date_from|date_to -> last_calculated_at
+	state map[string]time.Time
+	// metric query result
+	columns []fakeColumn
+	rows    [][]driver.Value
+	// returned by all queries when set
+	err error
+}
+
+// fakeExec is a single executed statement
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+// fakeColumn is a metric query result column
+type fakeColumn struct {
+	name, dbType string
+	nullable     bool
+}
+
+var (
+	gFakeDBs    = make(map[string]*fakeDB)
+	gFakeDBsMtx = &sync.Mutex{}
+	// insert into "table"(columns) values
+	gFakeInsertRe = regexp.MustCompile(`^insert into "([^"]+)"\(([^)]*)\) values`)
+	// isCalculated query
+	gFakeStateRe = regexp.MustCompile(`^select last_calculated_at from "([^"]+)" where project_slug = \$1 and time_range = \$2 and date_from = \$3 and date_to = \$4$`)
+)
+
+// newFakeDB registers a new fake database and returns it with a *sql.DB connected to it
+func newFakeDB(t *testing.T) (*fakeDB, *sql.DB) {
+	fdb := &fakeDB{state: make(map[string]time.Time)}
+	gFakeDBsMtx.Lock()
+	name := fmt.Sprintf("%s-%d", t.Name(), len(gFakeDBs))
+	gFakeDBs[name] = fdb
+	gFakeDBsMtx.Unlock()
+	db, err := sql.Open("fakedb", name)
+	if err != nil {
+		t.Fatalf("open: %+v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return fdb, db
+}
+
+// inserts returns executed insert statements into table
+func (fdb *fakeDB) inserts(table string) []fakeExec {
+	fdb.mtx.Lock()
+	defer fdb.mtx.Unlock()
+	execs := []fakeExec{}
+	for _, e := range fdb.execs {
+		if strings.HasPrefix(e.query, `insert into "`+table+`"(`) {
+			execs = append(execs, e)
+		}
+	}
+	return execs
+}
+
+func (fdb *fakeDB) exec(query string, args []driver.Value) (driver.Result, error) {
+	fdb.mtx.Lock()
+	defer fdb.mtx.Unlock()
+	if fdb.err != nil {
+		return nil, fdb.err
+	}
+	fdb.execs = append(fdb.execs, fakeExec{query: query, args: args})
+	m := gFakeInsertRe.FindStringSubmatch(query)
+	if m == nil {
+		return driver.RowsAffected(0), nil
+	}
+	cols := strings.Split(m[2], ", ")
+	nRows := len(args) / len(cols)
+	for r := 0; r < nRows; r++ {
+		row := make(map[string]driver.Value)
+		for j, col := range cols {
+			row[col] = args[r*len(cols)+j]
+		}
+		calcDt, ok := row["last_calculated_at"].(time.Time)
+		if ok {
+			fdb.state[fmt.Sprintf("%s|%v|%v|%v|%v", m[1], row["time_range"], row["project_slug"], row["date_from"], row["date_to"])] = calcDt
+		}
+	}
+	return driver.RowsAffected(nRows), nil
+}
+
+func (fdb *fakeDB) query(query string, args []driver.Value) (driver.Rows, error) {
+	fdb.mtx.Lock()
+	defer fdb.mtx.Unlock()
+	if fdb.err != nil {
+		return nil, fdb.err
+	}
+	m := gFakeStateRe.FindStringSubmatch(query)
+	if m != nil {
+		rows := &fakeRows{columns: []fakeColumn{{name: "last_calculated_at", dbType: "TIMESTAMP"}}}
+		calcDt, ok := fdb.state[fmt.Sprintf("%s|%v|%v|%v|%v", m[1], args[1], args[0], args[2], args[3])]
+		if ok {
+			rows.rows = [][]driver.Value{{calcDt}}
+		}
+		return rows, nil
+	}
+	return &fakeRows{columns: fdb.columns, rows: fdb.rows}, nil
+}
+
+type fakeDriver struct{}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	gFakeDBsMtx.Lock()
+	defer gFakeDBsMtx.Unlock()
+	fdb, ok := gFakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown fake database: %s", name)
+	}
+	return &fakeConn{db: fdb}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.db.exec(s.query, args)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.db.query(s.query, args)
+}
+
+type fakeRows struct {
+	columns []fakeColumn
+	rows    [][]driver.Value
+	i       int
+}
+
+func (r *fakeRows) Columns() []string {
+	names := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		names[i] = column.name
+	}
+	return names
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.columns[index].dbType
+}
+
+func (r *fakeRows) ColumnTypeNullable(index int) (bool, bool) {
+	return r.columns[index].nullable, true
+}
+
+// calcEnv returns minimal env for calculate
+func calcEnv(kv ...string) map[string]string {
+	env := map[string]string{"METRIC": "m", "TABLE": "t", "PROJECT_SLUG": "p", "TIME_RANGE": "c"}
+	for i := 0; i+1 < len(kv); i += 2 {
+		env[kv[i]] = kv[i+1]
+	}
+	return env
+}
+
+// metricRows returns n rows of (name text, value int8) metric result
+func metricRows(n int) ([]fakeColumn, [][]driver.Value) {
+	rows := [][]driver.Value{}
+	for i := 0; i < n; i++ {
+		rows = append(rows, []driver.Value{fmt.Sprintf("name%d", i), int64(i)})
+	}
+	return []fakeColumn{{name: "name", dbType: "TEXT"}, {name: "value", dbType: "INT8"}}, rows
+}
+
+func TestMatviewName(t *testing.T) {
+	dtf := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	dtt := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		table, projectSlug, timeRange, expected string
+	}{
+		{"metric_x", "korg", "7d", "metric_x__korg_7d"},
+		{"metric_x", "my-proj", "q", "metric_x__my_proj_q"},
+		{"metric_x", "korg", "c", "metric_x__korg_c_20230101_20230201"},
+	}
+	for _, test := range tests {
+		got := matviewName(test.table, test.projectSlug, test.timeRange, dtf, dtt)
+		if got != test.expected {
+			t.Errorf("%+v: expected %s, got %s", test, test.expected, got)
+		}
+	}
+	long := matviewName(strings.Repeat("t", 60), "korg", "7d", dtf, dtt)
+	if len(long) != 63 || long == matviewName(strings.Repeat("t", 60), "korg", "30d", dtf, dtt) {
+		t.Errorf("long names must be shortened to unique 63 characters names, got %s", long)
+	}
+}
+
+func TestWeekStart7d(t *testing.T) {
+	// 2024-06-05 is a Wednesday
+	tests := []struct {
+		weekStart string
+		dtf, dtt  time.Time
+	}{
+		{"", ymd(2024, 5, 27), ymd(2024, 6, 3)},
+		{"monday", ymd(2024, 5, 27), ymd(2024, 6, 3)},
+		{"Monday", ymd(2024, 5, 27), ymd(2024, 6, 3)},
+		{"sunday", ymd(2024, 5, 26), ymd(2024, 6, 2)},
+	}
+	for _, test := range tests {
+		env := map[string]string{"NOW": "2024-06-05 13:14:15"}
+		if test.weekStart != "" {
+			env["WEEK_START"] = test.weekStart
+		}
+		dtf, dtt := currentTimeRange("7d", false, env)
+		if !dtf.Equal(test.dtf) || !dtt.Equal(test.dtt) {
+			t.Errorf("WEEK_START=%s: expected %v - %v, got %v - %v", test.weekStart, test.dtf, test.dtt, dtf, dtt)
+		}
+	}
+}
+
+func TestBatchSQLMidLoopAndFinalFlush(t *testing.T) {
+	// 6 synthetic + 2 metric columns = 8 placeholders per row
+	flushed := func(maxP string) []fakeExec {
+		fdb, db := newFakeDB(t)
+		fdb.columns, fdb.rows = metricRows(2)
+		err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, calcEnv("MAX_PLACEHOLDERS", maxP))
+		if err != nil {
+			t.Fatalf("calculate: %+v", err)
+		}
+		return fdb.inserts("t")
+	}
+	// 16 placeholders: 2 rows fill the batch, so it is flushed in the loop
+	midLoop := flushed("16")
+	// 24 placeholders: 2 rows don't fill the batch, so they are flushed after the loop
+	final := flushed("24")
+	if len(midLoop) != 1 || len(final) != 1 {
+		t.Fatalf("expected a single batch in both cases, got %d and %d", len(midLoop), len(final))
+	}
+	if midLoop[0].query != final[0].query {
+		t.Errorf("mid-loop and final flush SQL differ:\n%s\n%s", midLoop[0].query, final[0].query)
+	}
+	expected := batchSQL("t", "time_range, project_slug, last_calculated_at, date_from, date_to, row_number", conflictSQL("time_range, project_slug, date_from, date_to, row_number", "update", "", []string{"name", "value"}, nil), 6, []string{"name", "value"}, 2)
+	if midLoop[0].query != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, midLoop[0].query)
+	}
+}
+
+func TestBatchPlaceholdersBoundary(t *testing.T) {
+	// 6 synthetic + 2 metric columns = 8 placeholders per row
+	tests := []struct {
+		maxP    int
+		batches int
+	}{
+		{8, 5},
+		{15, 5},
+		{16, 3},
+		{17, 3},
+		{24, 2},
+		{40, 1},
+	}
+	for _, test := range tests {
+		fdb, db := newFakeDB(t)
+		fdb.columns, fdb.rows = metricRows(5)
+		err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, calcEnv("MAX_PLACEHOLDERS", fmt.Sprintf("%d", test.maxP)))
+		if err != nil {
+			t.Fatalf("maxP %d: calculate: %+v", test.maxP, err)
+		}
+		inserts := fdb.inserts("t")
+		if len(inserts) != test.batches {
+			t.Errorf("maxP %d: expected %d batches, got %d", test.maxP, test.batches, len(inserts))
+		}
+		nArgs := 0
+		for _, insert := range inserts {
+			if len(insert.args) > test.maxP {
+				t.Errorf("maxP %d: batch has %d placeholders", test.maxP, len(insert.args))
+			}
+			nArgs += len(insert.args)
+		}
+		if nArgs != 5*8 {
+			t.Errorf("maxP %d: expected %d values written, got %d", test.maxP, 5*8, nArgs)
+		}
+	}
+	// a single row doesn't fit
+	fdb, db := newFakeDB(t)
+	fdb.columns, fdb.rows = metricRows(5)
+	err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, calcEnv("MAX_PLACEHOLDERS", "7"))
+	if err == nil || !strings.Contains(err.Error(), "table is too wide") {
+		t.Errorf("maxP 7: expected table is too wide error, got %v", err)
+	}
+}
+
+func TestByteaRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	values := [][]byte{nil, {}, {0}, {0, 0xff, '\\', '\'', 0x80}}
+	for i := 0; i < 20; i++ {
+		b := make([]byte, rnd.Intn(256))
+		_, _ = rnd.Read(b)
+		values = append(values, b)
+	}
+	fdb, db := newFakeDB(t)
+	fdb.columns = []fakeColumn{{name: "id", dbType: "INT8"}, {name: "hash", dbType: "BYTEA", nullable: true}}
+	for i, value := range values {
+		fdb.rows = append(fdb.rows, []driver.Value{int64(i), value})
+	}
+	err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, calcEnv())
+	if err != nil {
+		t.Fatalf("calculate: %+v", err)
+	}
+	inserts := fdb.inserts("t")
+	if len(inserts) != 1 {
+		t.Fatalf("expected a single batch, got %d", len(inserts))
+	}
+	args := inserts[0].args
+	for i, value := range values {
+		got := args[i*8+7]
+		if value == nil {
+			if got != nil {
+				t.Errorf("row %d: expected null, got %v", i, got)
+			}
+			continue
+		}
+		b, ok := got.([]byte)
+		if !ok {
+			t.Errorf("row %d: expected []byte, got %T", i, got)
+			continue
+		}
+		if !bytes.Equal(b, value) {
+			t.Errorf("row %d: expected %x, got %x", i, value, b)
+		}
+	}
+}
+
+func TestConflictSQLActions(t *testing.T) {
+	keyCols := "time_range, project_slug, date_from, date_to, row_number"
+	tests := []struct {
+		action   string
+		where    string
+		colNames []string
+		expected string
+	}{
+		{"update", "", []string{"a", "b"}, " on conflict(" + keyCols + ") do update set (a, b) = (excluded.a, excluded.b)"},
+		{"update", "", []string{"a"}, " on conflict(" + keyCols + ") do update set a = excluded.a"},
+		{"update", `"t".a is distinct from excluded.a`, []string{"a", "b"}, " on conflict(" + keyCols + `) do update set (a, b) = (excluded.a, excluded.b) where "t".a is distinct from excluded.a`},
+		{"update", "", []string{}, " on conflict(" + keyCols + ") do nothing"},
+		{"nothing", "", []string{"a", "b"}, " on conflict(" + keyCols + ") do nothing"},
+		{"nothing", "", []string{}, " on conflict(" + keyCols + ") do nothing"},
+	}
+	for _, test := range tests {
+		got := conflictSQL(keyCols, test.action, test.where, test.colNames, nil)
+		if got != test.expected {
+			t.Errorf("%s %v: expected %q, got %q", test.action, test.colNames, test.expected, got)
+		}
+	}
+	// no primary key - plain insert
+	for _, action := range []string{"update", "nothing"} {
+		got := conflictSQL("", action, "", []string{"a"}, nil)
+		if got != "" {
+			t.Errorf("%s without key columns: expected plain insert, got %q", action, got)
+		}
+	}
+}
+
+func TestConflictActionWrites(t *testing.T) {
+	for _, action := range []string{"update", "nothing"} {
+		fdb, db := newFakeDB(t)
+		fdb.columns, fdb.rows = metricRows(2)
+		err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, calcEnv("CONFLICT_ACTION", action))
+		if err != nil {
+			t.Fatalf("%s: calculate: %+v", action, err)
+		}
+		inserts := fdb.inserts("t")
+		if len(inserts) != 1 {
+			t.Fatalf("%s: expected a single batch, got %d", action, len(inserts))
+		}
+		expected := " on conflict(time_range, project_slug, date_from, date_to, row_number) do nothing"
+		if action == "update" {
+			expected = " on conflict(time_range, project_slug, date_from, date_to, row_number) do update set (name, value) = (excluded.name, excluded.value)"
+		}
+		if !strings.HasSuffix(inserts[0].query, expected) {
+			t.Errorf("%s: expected query ending with %q, got %s", action, expected, inserts[0].query)
+		}
+	}
+	_, db := newFakeDB(t)
+	err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, calcEnv("CONFLICT_ACTION", "ignore"))
+	if err == nil {
+		t.Errorf("expected error for unknown conflict action")
+	}
+}
+
+func TestRequestEnvAllowList(t *testing.T) {
+	env := map[string]string{"METRIC": "m", "TABLE": "t", "DAEMON": ":8080", "DAEMON_TOKEN": "secret", "PARAM_is_bot": "!= true"}
+	reqEnv, err := requestEnv(env, &calcRequest{ProjectSlug: "proj", Env: map[string]string{"V3_FORCE_CALC": "1"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %+v", err)
+	}
+	if reqEnv["FORCE_CALC"] != "1" || reqEnv["PROJECT_SLUG"] != "proj" {
+		t.Errorf("request values not applied: %+v", reqEnv)
+	}
+	if _, ok := reqEnv["DAEMON_TOKEN"]; ok {
+		t.Errorf("daemon token leaked into request env")
+	}
+	reqEnv, err = requestEnv(env, &calcRequest{Params: map[string]string{"is_bot": "= true"}})
+	if err != nil || reqEnv["PARAM_is_bot"] != "= true" {
+		t.Errorf("param defined by the daemon not applied: %+v (%v)", reqEnv, err)
+	}
+	for _, key := range []string{"FILE_ids", "ids", "base_table"} {
+		_, err = requestEnv(env, &calcRequest{Params: map[string]string{key: "1); drop table t; --"}})
+		if err == nil {
+			t.Errorf("%s param: expected error", key)
+		}
+	}
+	for _, key := range []string{"SQL_PATH", "V3_PARAM_FILE_x", "SESSION_SQL", "DROP", "DELETE", "PROJECTS_SQL"} {
+		_, err = requestEnv(env, &calcRequest{Env: map[string]string{key: "x"}})
+		if err == nil {
+			t.Errorf("%s: expected error", key)
+		}
+	}
+}
+
+func TestDaemonAddr(t *testing.T) {
+	tests := []struct {
+		addr, token, expected string
+		fail                  bool
+	}{
+		{addr: ":8080", expected: "127.0.0.1:8080"},
+		{addr: "localhost:8080", expected: "localhost:8080"},
+		{addr: "[::1]:8080", expected: "[::1]:8080"},
+		{addr: "0.0.0.0:8080", fail: true},
+		{addr: "0.0.0.0:8080", token: "secret", expected: "0.0.0.0:8080"},
+		{addr: ":8080", token: "secret", expected: ":8080"},
+		{addr: "8080", fail: true},
+	}
+	for _, test := range tests {
+		got, err := daemonAddr(test.addr, test.token)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", test.addr, got)
+			}
+			continue
+		}
+		if err != nil || got != test.expected {
+			t.Errorf("%s: expected %s, got %s (%v)", test.addr, test.expected, got, err)
+		}
+	}
+}
+
+func TestIsCalculatedMissingTableOrColumn(t *testing.T) {
+	tests := []struct {
+		code pq.ErrorCode
+		fail bool
+	}{
+		{"42703", false}, // undefined_column
+		{"42P01", false}, // undefined_table
+		{"42501", true},  // insufficient_privilege
+	}
+	for _, test := range tests {
+		fdb, db := newFakeDB(t)
+		fdb.err = &pq.Error{Code: test.code, Message: `column "last_calculated_at" does not exist`}
+		isCalc, err := isCalculated(db, "t", "p", "7d", false, calcEnv(), ymd(2024, 5, 27), ymd(2024, 6, 3))
+		if isCalc {
+			t.Errorf("%s: expected calculation to be needed", test.code.Name())
+		}
+		if !test.fail {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %+v", test.code.Name(), err)
+			}
+			continue
+		}
+		var queryErr *lib.ErrQuery
+		if !errors.As(err, &queryErr) {
+			t.Errorf("%s: expected *lib.ErrQuery, got %T %v", test.code.Name(), err, err)
+		}
+	}
+}
+
+func TestOutputTargetsState(t *testing.T) {
+	tests := []struct {
+		output, stateTable string
+		fail               bool
+	}{
+		{"", "", false},
+		{"kafka", "", true},
+		{"kafka", "state", false},
+		{"kafka,db", "", false},
+		{"json", "", false},
+		{"parquet", "", true},
+		{"parquet,json", "", true},
+		{"parquet", "state", false},
+		{"parquet,table", "", false},
+	}
+	for _, test := range tests {
+		_, err := outputTargets(map[string]string{"OUTPUT": test.output, "STATE_TABLE": test.stateTable})
+		if (err != nil) != test.fail {
+			t.Errorf("OUTPUT=%s STATE_TABLE=%s: expected error %v, got %v", test.output, test.stateTable, test.fail, err)
+		}
+	}
+}
+
+func TestIsCalculatedDateRoundTrip(t *testing.T) {
+	fdb, db := newFakeDB(t)
+	_, err := db.Exec(
+		`insert into "t"(time_range, project_slug, last_calculated_at, date_from, date_to, row_number, value) values ($1, $2, $3, $4, $5, $6, $7)`,
+		"q", "p", time.Now(), "2024-04-01", "2024-07-01", 1, 10,
+	)
+	if err != nil {
+		t.Fatalf("insert: %+v", err)
+	}
+	tests := []struct {
+		dtf, dtt time.Time
+		isCalc   bool
+	}{
+		{ymd(2024, 4, 1), ymd(2024, 7, 1), true},
+		// only days are compared
+		{ymd(2024, 4, 1).Add(13 * time.Hour), ymd(2024, 7, 1).Add(time.Minute), true},
+		{ymd(2024, 4, 1), ymd(2024, 6, 30), false},
+		{ymd(2024, 4, 2), ymd(2024, 7, 1), false},
+	}
+	for _, test := range tests {
+		isCalc, err := isCalculated(db, "t", "p", "q", false, calcEnv(), test.dtf, test.dtt)
+		if err != nil {
+			t.Fatalf("isCalculated: %+v", err)
+		}
+		if isCalc != test.isCalc {
+			t.Errorf("%v - %v: expected calculated %v, got %v", test.dtf, test.dtt, test.isCalc, isCalc)
+		}
+	}
+	// the same key in another table or for another project is not calculated
+	isCalc, _ := isCalculated(db, "t2", "p", "q", false, calcEnv(), ymd(2024, 4, 1), ymd(2024, 7, 1))
+	isCalc2, _ := isCalculated(db, "t", "p2", "q", false, calcEnv(), ymd(2024, 4, 1), ymd(2024, 7, 1))
+	if isCalc || isCalc2 {
+		t.Errorf("expected other table and project to need calculation")
+	}
+	if len(fdb.inserts("t")) != 1 {
+		t.Errorf("expected isCalculated not to write anything")
+	}
+}
+
+func TestDateBinds(t *testing.T) {
+	dtf, dtt := ymd(2024, 4, 1).Add(5*time.Hour), ymd(2024, 7, 1).Add(23*time.Hour)
+	df, dt := dateBinds(dtf, dtt, map[string]string{})
+	if df != "2024-04-01" || dt != "2024-07-01" {
+		t.Errorf("expected 2024-04-01 - 2024-07-01, got %s - %s", df, dt)
+	}
+	df, dt = dateBinds(dtf, dtt, map[string]string{"DATE_TO_INCLUSIVE": "1"})
+	if df != "2024-04-01" || dt != "2024-06-30" {
+		t.Errorf("DATE_TO_INCLUSIVE: expected 2024-04-01 - 2024-06-30, got %s - %s", df, dt)
+	}
+}
+
+func TestPrevModeYoY(t *testing.T) {
+	tests := []struct {
+		timeRange string
+		mode      string
+		dtf, dtt  time.Time
+	}{
+		{"q", "yoy", ymd(2024, 1, 1), ymd(2024, 4, 1)},
+		{"qp", "prior", ymd(2023, 10, 1), ymd(2024, 1, 1)},
+		{"qp", "yoy", ymd(2023, 1, 1), ymd(2023, 4, 1)},
+		{"30dp", "prior", ymd(2024, 3, 1), ymd(2024, 4, 1)},
+		{"30dp", "yoy", ymd(2023, 4, 1), ymd(2023, 5, 1)},
+		{"7dp", "yoy", ymd(2023, 5, 6), ymd(2023, 5, 13)},
+	}
+	for _, test := range tests {
+		env := map[string]string{"NOW": "2024-05-15", "PREV_MODE": test.mode}
+		dtf, dtt := currentTimeRange(test.timeRange, false, env)
+		if !dtf.Equal(test.dtf) || !dtt.Equal(test.dtt) {
+			t.Errorf("%s %s: expected %v - %v, got %v - %v", test.timeRange, test.mode, test.dtf, test.dtt, dtf, dtt)
+		}
+	}
+	// previous period of the current quarter is the same quarter of the prior year
+	env := map[string]string{"NOW": "2024-05-15", "PREV_MODE": "yoy"}
+	dtf, dtt := currentTimeRange("q", false, env)
+	pdtf, pdtt, err := previousTimeRange("q", dtf, dtt, false, env)
+	if err != nil || !pdtf.Equal(ymd(2023, 1, 1)) || !pdtt.Equal(ymd(2023, 4, 1)) {
+		t.Errorf("previous q with yoy: expected 2023-01-01 - 2023-04-01, got %v - %v (%v)", pdtf, pdtt, err)
+	}
+	_, _, err = previousTimeRange("2y", dtf, dtt, false, env)
+	if err == nil {
+		t.Errorf("expected error for 2y previous period with yoy")
+	}
+}
+
+func TestFinalState(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     int
+		env      map[string]string
+		err      error
+		expected int
+	}{
+		{"rows written", 3, calcEnv(), nil, lib.ExitOK},
+		{"no rows", 0, calcEnv(), nil, lib.ExitNoop},
+		{"no rows recorded", 0, calcEnv("RECORD_EMPTY", "1"), nil, lib.ExitOK},
+		{"query error", 3, calcEnv(), fmt.Errorf("connection reset"), lib.ExitError},
+	}
+	for _, test := range tests {
+		fdb, db := newFakeDB(t)
+		fdb.columns, fdb.rows = metricRows(test.rows)
+		fdb.err = test.err
+		setFinalState(lib.StateNoop)
+		err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, test.env)
+		if (err != nil) != (test.err != nil) {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		// main sets error state for any returned error
+		if err != nil {
+			setFinalState(lib.StateError)
+		}
+		got := lib.ExitCode(finalState())
+		if got != test.expected {
+			t.Errorf("%s: expected exit code %d, got %d (state %d)", test.name, test.expected, got, finalState())
+		}
+	}
+	// calculation not needed: state stays noop
+	fdb, db := newFakeDB(t)
+	fdb.columns, fdb.rows = metricRows(1)
+	err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, calcEnv())
+	if err != nil {
+		t.Fatalf("calculate: %+v", err)
+	}
+	setFinalState(lib.StateNoop)
+	calc, err := calcRange(db, "t", "p", "c", ymd(2024, 1, 1), ymd(2024, 2, 1), false, false, false, calcEnv())
+	if err != nil || calc {
+		t.Errorf("expected window to be already calculated, got calculated %v, error %v", calc, err)
+	}
+	if lib.ExitCode(finalState()) != lib.ExitNoop {
+		t.Errorf("expected exit code %d when calculation is not needed, got %d", lib.ExitNoop, lib.ExitCode(finalState()))
+	}
+	setFinalState(lib.StateNoop)
+}
+
+func TestCheckConflicts(t *testing.T) {
+	for _, conflict := range gConflictingFlags {
+		env := map[string]string{conflict[0]: "1", conflict[1]: "1"}
+		err := checkConflicts(env)
+		if err == nil {
+			t.Errorf("%s + %s: expected error", conflict[0], conflict[1])
+			continue
+		}
+		for _, name := range conflict[:2] {
+			if !strings.Contains(err.Error(), gPrefix+name) {
+				t.Errorf("%s + %s: error doesn't name %s%s: %v", conflict[0], conflict[1], gPrefix, name, err)
+			}
+		}
+		for _, name := range conflict[:2] {
+			err = checkConflicts(map[string]string{name: "1"})
+			if err != nil {
+				t.Errorf("%s alone: unexpected error: %v", name, err)
+			}
+		}
+	}
+	err := checkConflicts(calcEnv())
+	if err != nil {
+		t.Errorf("unexpected error for minimal env: %v", err)
+	}
+}
+
+func TestPlaceholdersComputedColumns(t *testing.T) {
+	// 6 synthetic + 2 metric columns + percentile = 9 placeholders per row
+	for _, test := range []struct {
+		maxP string
+		fail bool
+	}{{"8", true}, {"9", false}} {
+		fdb, db := newFakeDB(t)
+		fdb.columns, fdb.rows = metricRows(3)
+		err := calculate(db, "select", "", "t", "p", "c", "2024-01-01", "2024-02-01", false, false, calcEnv("MAX_PLACEHOLDERS", test.maxP, "PERCENTILE_COLUMN", "value"))
+		if test.fail {
+			if err == nil || !strings.Contains(err.Error(), "table is too wide") {
+				t.Errorf("maxP %s: expected table is too wide error, got %v", test.maxP, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("maxP %s: unexpected error: %+v", test.maxP, err)
+			continue
+		}
+		for _, insert := range fdb.inserts("t") {
+			if len(insert.args) > 9 {
+				t.Errorf("maxP %s: batch has %d placeholders", test.maxP, len(insert.args))
+			}
+		}
+	}
+}
+
+func TestYTDPrev(t *testing.T) {
+	// 2024 is a leap year: 2024-01-01 - 2024-07-02 is 183 days long
+	tests := []struct {
+		ytdPrev, prevMode string
+		dtf, dtt          time.Time
+	}{
+		{"", "", ymd(2023, 7, 2), ymd(2024, 1, 1)},
+		{"elapsed", "", ymd(2023, 7, 2), ymd(2024, 1, 1)},
+		{"yoy", "", ymd(2023, 1, 1), ymd(2023, 7, 2)},
+		// default follows V3_PREV_MODE
+		{"", "yoy", ymd(2023, 1, 1), ymd(2023, 7, 2)},
+		{"elapsed", "yoy", ymd(2023, 7, 2), ymd(2024, 1, 1)},
+	}
+	for _, test := range tests {
+		env := map[string]string{"NOW": "2024-07-02 10:00:00"}
+		if test.ytdPrev != "" {
+			env["YTD_PREV"] = test.ytdPrev
+		}
+		if test.prevMode != "" {
+			env["PREV_MODE"] = test.prevMode
+		}
+		dtf, dtt := currentTimeRange("ty", false, env)
+		if !dtf.Equal(ymd(2024, 1, 1)) || !dtt.Equal(ymd(2024, 7, 2)) {
+			t.Errorf("ty: expected 2024-01-01 - 2024-07-02, got %v - %v", dtf, dtt)
+		}
+		dtf, dtt = currentTimeRange("typ", false, env)
+		if !dtf.Equal(test.dtf) || !dtt.Equal(test.dtt) {
+			t.Errorf("YTD_PREV=%s PREV_MODE=%s: expected %v - %v, got %v - %v", test.ytdPrev, test.prevMode, test.dtf, test.dtt, dtf, dtt)
+		}
+	}
+}
+
+func TestCalculatedWindowDetectedOnNextRun(t *testing.T) {
+	sqlPath := t.TempDir() + "/"
+	err := ioutil.WriteFile(sqlPath+"m.sql", []byte("select name, value from metric where dt >= {{date_from}} and dt < {{date_to}}\n"), 0644)
+	if err != nil {
+		t.Fatalf("write SQL: %+v", err)
+	}
+	tests := []map[string]string{
+		calcEnv("SQL_PATH", sqlPath, "TIME_RANGE", "q"),
+		calcEnv("SQL_PATH", sqlPath, "TIME_RANGE", "q", "DATE_TO_INCLUSIVE", "1"),
+		calcEnv("SQL_PATH", sqlPath, "TIME_RANGE", "q", "STATE_TABLE", "state"),
+		calcEnv("SQL_PATH", sqlPath, "TIME_RANGE", "q", "STATE_TABLE", "state", "DATE_TO_INCLUSIVE", "1"),
+	}
+	for _, env := range tests {
+		fdb, db := newFakeDB(t)
+		fdb.columns, fdb.rows = metricRows(2)
+		dtf, dtt := ymd(2024, 4, 1), ymd(2024, 7, 1)
+		for run, expected := range []bool{true, false} {
+			calc, err := calcRange(db, "t", "p", "q", dtf, dtt, false, false, false, env)
+			if err != nil {
+				t.Fatalf("%+v run %d: %+v", env, run+1, err)
+			}
+			if calc != expected {
+				t.Errorf("%+v run %d: expected calculated %v, got %v", env, run+1, expected, calc)
+			}
+		}
+		table := "t"
+		if env["STATE_TABLE"] != "" {
+			table = "state"
+		}
+		inserts := fdb.inserts(table)
+		if len(inserts) != 1 {
+			t.Fatalf("%+v: expected a single insert into %s, got %d", env, table, len(inserts))
+		}
+		expected := "2024-07-01"
+		if env["DATE_TO_INCLUSIVE"] != "" {
+			expected = "2024-06-30"
+		}
+		found := false
+		for _, arg := range inserts[0].args {
+			if arg == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%+v: expected stored date_to %s, got %v", env, expected, inserts[0].args)
+		}
+	}
+	setFinalState(lib.StateNoop)
+}
+
+func TestJSONRowsPercentileAndPctOfTotal(t *testing.T) {
+	names := []string{"time_range", "project_slug", "value", "percentile", "value_pct"}
+	types := jsonColumnTypes(2, []string{"int8"}, true, true)
+	if len(types) != len(names) {
+		t.Fatalf("expected %d types, got %d: %v", len(names), len(types), types)
+	}
+	var buf bytes.Buffer
+	jr := &jsonRows{w: &buf}
+	err := jr.write(names, types, []interface{}{"7d", "proj", "10", 50.0, 25.0})
+	if err != nil {
+		t.Fatalf("write: %+v", err)
+	}
+	jr.close()
+	var rows []map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &rows)
+	if err != nil {
+		t.Fatalf("invalid JSON %q: %+v", buf.String(), err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected 1 row, got %d", len(rows))
+	}
+	expected := map[string]interface{}{"time_range": "7d", "project_slug": "proj", "value": 10.0, "percentile": 50.0, "value_pct": 25.0}
+	for k, v := range expected {
+		if rows[0][k] != v {
+			t.Errorf("column %s: expected %v, got %v", k, v, rows[0][k])
+		}
+	}
+}
@@ -149,7 +149,7 @@ func execCommand(debug bool, cmdAndArgs []string, env map[string]string) (string
 	if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			rCode := exiterr.ExitCode()
-			if rCode == 66 {
+			if rCode == lib.ExitNoop {
 				err = nil
 				skipped = true
 			}
@@ -348,6 +348,9 @@ func runTasks(db *sql.DB, metrics Metrics, debug bool, env map[string]string) er
 			if err != nil {
 				return err
 			}
+		} else if strings.Contains(slugs, ":") {
+			// meta projects (name:slug1,slug2) are separated by ';'
+			slugsAry = strings.Split(slugs, ";")
 		} else {
 			slugsAry = strings.Split(slugs, ",")
 		}
@@ -653,6 +656,10 @@ func sync() error {
 			env[key[prefixLen:]] = val
 		}
 	}
+	timeFormat, _ := env["TIME_FORMAT"]
+	if timeFormat != "" {
+		lib.LogTimeLayout = lib.TimeLayout(timeFormat)
+	}
 	_, debug := env["DEBUG"]
 	if debug {
 		lib.Logf("map: %+v\n", env)
@@ -0,0 +1,57 @@
+package calcmetric
+
+import "fmt"
+
+// Typed errors returned by calcmetric, library consumers can tell them apart using errors.As
+// Error() messages are the same as printed by the calcmetric program
+
+// ErrMissingEnv - required environment variable is not set
+type ErrMissingEnv struct {
+	// Name - full variable name, for example V3_METRIC
+	Name string
+}
+
+func (e *ErrMissingEnv) Error() string {
+	return fmt.Sprintf("you must define %s environment variable to run this", e.Name)
+}
+
+// ErrParse - value (usually of an environment variable) cannot be parsed
+type ErrParse struct {
+	// What - what was parsed, for example V3_NOW
+	What string
+	Err  error
+}
+
+func (e *ErrParse) Error() string {
+	return fmt.Sprintf("cannot parse %s: %+v", e.What, e.Err)
+}
+
+// Unwrap - return the underlying parse error
+func (e *ErrParse) Unwrap() error {
+	return e.Err
+}
+
+// ErrQuery - SQL query failed, Err is the driver error (for example *pq.Error)
+type ErrQuery struct {
+	Query string
+	Err   error
+}
+
+func (e *ErrQuery) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap - return the driver error
+func (e *ErrQuery) Unwrap() error {
+	return e.Err
+}
+
+// ErrSchemaMismatch - existing table is not compatible with the current calculation settings
+type ErrSchemaMismatch struct {
+	Table string
+	Msg   string
+}
+
+func (e *ErrSchemaMismatch) Error() string {
+	return e.Msg
+}
@@ -3,6 +3,12 @@ module github.com/lukaszgryglicki/calcmetric
 go 1.20
 
 require (
-	github.com/lib/pq v1.10.9 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/lib/pq v1.10.9
+	github.com/segmentio/kafka-go v0.4.47
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 )
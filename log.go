@@ -2,10 +2,20 @@ package calcmetric
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"reflect"
 	"time"
 )
 
+// LogOutput - where Logf and QueryOut write to, library consumers can replace it
+// Defaults to stdout
+var LogOutput io.Writer = os.Stdout
+
+// LogTimeLayout - golang time layout used to prefix Logf lines
+// When empty ToYMDHMS format is used
+var LogTimeLayout string
+
 // QueryOut - output query and its arguments
 func QueryOut(query string, args ...interface{}) {
 	Logf("%s\n", query)
@@ -26,6 +36,12 @@ func QueryOut(query string, args ...interface{}) {
 }
 
 // Logf is a wrapper around Printf(...) that supports logging.
+// It writes to LogOutput
 func Logf(format string, args ...interface{}) (int, error) {
-	return fmt.Printf("%s: "+format, append([]interface{}{ToYMDHMS(time.Now())}, args...)...)
+	now := time.Now()
+	dt := ToYMDHMS(now)
+	if LogTimeLayout != "" {
+		dt = now.Format(LogTimeLayout)
+	}
+	return fmt.Fprintf(LogOutput, "%s: "+format, append([]interface{}{dt}, args...)...)
 }
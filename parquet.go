@@ -0,0 +1,430 @@
+package calcmetric
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parquet physical types, converted types and other constants from parquet.thrift
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetDate            = 6
+	parquetTimestampMicros = 10
+	parquetJSON            = 19
+
+	parquetOptional   = 1
+	parquetPlain      = 0
+	parquetRLE        = 3
+	parquetDataPage   = 0
+	parquetUncompress = 0
+)
+
+// Thrift compact protocol field types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// ParquetColumn - parquet file column, Type is a Postgres type name (as used in create table)
+// which is mapped to parquet physical and logical types
+type ParquetColumn struct {
+	Name string
+	Type string
+}
+
+type parquetColumn struct {
+	name      string
+	physical  int
+	converted int
+	values    []interface{}
+	nulls     int
+}
+
+// ParquetWriter - buffers rows and writes them as a single row group parquet file
+// all columns are optional, values are PLAIN encoded and uncompressed
+type ParquetWriter struct {
+	columns []*parquetColumn
+	rows    int64
+}
+
+// NewParquetWriter - returns parquet writer for given columns
+func NewParquetWriter(columns []ParquetColumn) *ParquetWriter {
+	pw := &ParquetWriter{}
+	for _, column := range columns {
+		physical, converted := parquetType(column.Type)
+		pw.columns = append(pw.columns, &parquetColumn{name: column.Name, physical: physical, converted: converted})
+	}
+	return pw
+}
+
+// parquetType - maps Postgres type to parquet physical type and converted (logical) type (-1 when there is none)
+func parquetType(pgType string) (int, int) {
+	tp := strings.ToLower(strings.TrimSpace(pgType))
+	i := strings.Index(tp, "(")
+	if i >= 0 {
+		tp = strings.TrimSpace(tp[:i])
+	}
+	switch tp {
+	case "bool", "boolean":
+		return parquetBoolean, -1
+	case "smallint", "int", "integer", "int2", "int4":
+		return parquetInt32, -1
+	case "bigint", "int8":
+		return parquetInt64, -1
+	case "real", "float4", "double precision", "float8", "numeric", "decimal":
+		return parquetDouble, -1
+	case "date":
+		return parquetInt32, parquetDate
+	case "timestamp", "timestamptz":
+		return parquetInt64, parquetTimestampMicros
+	case "bytea":
+		return parquetByteArray, -1
+	case "json", "jsonb":
+		return parquetByteArray, parquetJSON
+	default:
+		return parquetByteArray, parquetUTF8
+	}
+}
+
+// Rows - returns number of rows written so far
+func (pw *ParquetWriter) Rows() int64 {
+	return pw.rows
+}
+
+// Write - adds a single row, values are in columns order
+// values can be strings in Postgres text format (as scanned from the database) or native Go values
+func (pw *ParquetWriter) Write(values []interface{}) error {
+	if len(values) != len(pw.columns) {
+		return fmt.Errorf("parquet: got %d values for %d columns", len(values), len(pw.columns))
+	}
+	converted := make([]interface{}, len(values))
+	for i, value := range values {
+		column := pw.columns[i]
+		v, err := parquetValue(value, column.physical, column.converted)
+		if err != nil {
+			return fmt.Errorf("parquet: column '%s': %+v", column.name, err)
+		}
+		converted[i] = v
+	}
+	for i, v := range converted {
+		pw.columns[i].values = append(pw.columns[i].values, v)
+		if v == nil {
+			pw.columns[i].nulls++
+		}
+	}
+	pw.rows++
+	return nil
+}
+
+// parseTimestamp - parses date or timestamp in Postgres text format
+func parseTimestamp(s string) (time.Time, error) {
+	layouts := []string{
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02 15:04:05.999999999Z07",
+		"2006-01-02 15:04:05.999999999Z07:00",
+		time.RFC3339Nano,
+		"2006-01-02",
+	}
+	for _, layout := range layouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse timestamp: '%s'", s)
+}
+
+// parquetValue - converts value to int32, int64, float64, bool or []byte depending on parquet type, nil means null
+func parquetValue(value interface{}, physical, converted int) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if b, ok := value.([]byte); ok && physical != parquetByteArray {
+		value = string(b)
+	}
+	str, isStr := value.(string)
+	if isStr && str == "" && physical != parquetByteArray {
+		return nil, nil
+	}
+	if converted == parquetDate || converted == parquetTimestampMicros {
+		t, ok := value.(time.Time)
+		if !ok {
+			var err error
+			t, err = parseTimestamp(fmt.Sprintf("%v", value))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if converted == parquetDate {
+			return int32(math.Floor(float64(t.Unix()) / 86400.0)), nil
+		}
+		return t.UnixNano() / 1000, nil
+	}
+	switch physical {
+	case parquetBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		default:
+			return strconv.ParseBool(fmt.Sprintf("%v", v))
+		}
+	case parquetInt32:
+		i, err := strconv.ParseInt(fmt.Sprintf("%v", value), 10, 32)
+		return int32(i), err
+	case parquetInt64:
+		return strconv.ParseInt(fmt.Sprintf("%v", value), 10, 64)
+	case parquetDouble:
+		return strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
+	default:
+		switch v := value.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			return []byte(v), nil
+		case time.Time:
+			return []byte(ToYMDHMSf(v, 6)), nil
+		default:
+			return []byte(fmt.Sprintf("%v", v)), nil
+		}
+	}
+}
+
+// WriteTo - writes buffered rows as a parquet file
+func (pw *ParquetWriter) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	buf.WriteString("PAR1")
+	chunks := make([][]byte, len(pw.columns))
+	totalSize := int64(0)
+	for i, column := range pw.columns {
+		page := column.page()
+		header := &thriftWriter{}
+		// PageHeader: type, uncompressed_page_size, compressed_page_size, data_page_header
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.structBegin(5)
+		// DataPageHeader: num_values, encoding, definition_level_encoding, repetition_level_encoding
+		header.i32(1, int32(len(column.values)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.structEnd()
+		header.stop()
+		offset := int64(buf.Len())
+		buf.Write(header.buf.Bytes())
+		buf.Write(page)
+		size := int64(buf.Len()) - offset
+		totalSize += size
+		// ColumnChunk: file_offset, meta_data
+		chunk := &thriftWriter{}
+		chunk.i64(2, offset)
+		chunk.structBegin(3)
+		// ColumnMetaData: type, encodings, path_in_schema, codec, num_values, sizes, data_page_offset
+		chunk.i32(1, int32(column.physical))
+		chunk.listBegin(2, thriftI32, 2)
+		chunk.varint(zigzag(parquetPlain))
+		chunk.varint(zigzag(parquetRLE))
+		chunk.listBegin(3, thriftBinary, 1)
+		chunk.binary([]byte(column.name))
+		chunk.i32(4, parquetUncompress)
+		chunk.i64(5, int64(len(column.values)))
+		chunk.i64(6, size)
+		chunk.i64(7, size)
+		chunk.i64(9, offset)
+		chunk.structEnd()
+		chunk.stop()
+		chunks[i] = chunk.buf.Bytes()
+	}
+	// FileMetaData: version, schema, num_rows, row_groups, created_by
+	meta := &thriftWriter{}
+	meta.i32(1, 1)
+	meta.listBegin(2, thriftStruct, len(pw.columns)+1)
+	// root schema element: name, num_children
+	meta.elemBegin()
+	meta.fieldBegin(4, thriftBinary)
+	meta.binary([]byte("schema"))
+	meta.i32(5, int32(len(pw.columns)))
+	meta.elemEnd()
+	for _, column := range pw.columns {
+		// SchemaElement: type, repetition_type, name, converted_type
+		meta.elemBegin()
+		meta.i32(1, int32(column.physical))
+		meta.i32(3, parquetOptional)
+		meta.fieldBegin(4, thriftBinary)
+		meta.binary([]byte(column.name))
+		if column.converted >= 0 {
+			meta.i32(6, int32(column.converted))
+		}
+		meta.elemEnd()
+	}
+	meta.i64(3, pw.rows)
+	meta.listBegin(4, thriftStruct, 1)
+	// RowGroup: columns, total_byte_size, num_rows
+	meta.elemBegin()
+	meta.listBegin(1, thriftStruct, len(chunks))
+	for _, chunk := range chunks {
+		// column chunks are complete structs
+		meta.buf.Write(chunk)
+	}
+	meta.i64(2, totalSize)
+	meta.i64(3, pw.rows)
+	meta.elemEnd()
+	meta.fieldBegin(6, thriftBinary)
+	meta.binary([]byte("calcmetric"))
+	meta.stop()
+	buf.Write(meta.buf.Bytes())
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(meta.buf.Len()))
+	buf.WriteString("PAR1")
+	return buf.WriteTo(w)
+}
+
+// page - returns data page contents: RLE encoded definition levels followed by PLAIN encoded non null values
+func (c *parquetColumn) page() []byte {
+	var levels bytes.Buffer
+	n := len(c.values)
+	for i := 0; i < n; {
+		defined := c.values[i] != nil
+		j := i
+		for j < n && (c.values[j] != nil) == defined {
+			j++
+		}
+		levels.Write(uvarint(uint64(j-i) << 1))
+		if defined {
+			levels.WriteByte(1)
+		} else {
+			levels.WriteByte(0)
+		}
+		i = j
+	}
+	var page bytes.Buffer
+	_ = binary.Write(&page, binary.LittleEndian, uint32(levels.Len()))
+	page.Write(levels.Bytes())
+	if c.physical == parquetBoolean {
+		bits := make([]byte, (n-c.nulls+7)/8)
+		k := 0
+		for _, v := range c.values {
+			if v == nil {
+				continue
+			}
+			if v.(bool) {
+				bits[k/8] |= 1 << uint(k%8)
+			}
+			k++
+		}
+		page.Write(bits)
+		return page.Bytes()
+	}
+	for _, v := range c.values {
+		switch value := v.(type) {
+		case nil:
+		case int32, int64:
+			_ = binary.Write(&page, binary.LittleEndian, value)
+		case float64:
+			_ = binary.Write(&page, binary.LittleEndian, math.Float64bits(value))
+		case []byte:
+			_ = binary.Write(&page, binary.LittleEndian, uint32(len(value)))
+			page.Write(value)
+		}
+	}
+	return page.Bytes()
+}
+
+// thriftWriter - minimal thrift compact protocol encoder, enough to write parquet metadata
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  []int16
+	field int16
+}
+
+func uvarint(v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, v)]
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(uvarint(v))
+}
+
+func (t *thriftWriter) fieldBegin(id int16, tp byte) {
+	delta := id - t.field
+	if delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | tp)
+	} else {
+		t.buf.WriteByte(tp)
+		t.varint(zigzag(int64(id)))
+	}
+	t.field = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.fieldBegin(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.fieldBegin(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(b []byte) {
+	t.varint(uint64(len(b)))
+	t.buf.Write(b)
+}
+
+// listBegin - writes list field header, primitive elements are written directly, struct elements between elemBegin and elemEnd
+func (t *thriftWriter) listBegin(id int16, elemType byte, size int) {
+	t.fieldBegin(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+// elemBegin - starts a struct list element, it has its own field ids sequence
+func (t *thriftWriter) elemBegin() {
+	t.last = append(t.last, t.field)
+	t.field = 0
+}
+
+// elemEnd - terminates a struct list element
+func (t *thriftWriter) elemEnd() {
+	t.buf.WriteByte(0)
+	t.field = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.fieldBegin(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.elemEnd()
+}
+
+// stop - terminates a top level struct or a struct list element
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+	t.field = 0
+}
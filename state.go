@@ -0,0 +1,34 @@
+package calcmetric
+
+// Final states of a calcmetric run
+const (
+	// StateError - calculation failed
+	StateError = -1
+	// StateNoop - nothing was written, calculation was not needed (or metric returned no rows)
+	StateNoop = 0
+	// StateCalculated - calculation was needed and data was written
+	StateCalculated = 1
+)
+
+// Process exit codes of calcmetric
+const (
+	// ExitOK - data was calculated
+	ExitOK = 0
+	// ExitError - calculation failed
+	ExitError = 1
+	// ExitNoop - calculation was not needed, callers like sync use it to count skipped calculations
+	// it is a distinct non-zero code, so shell callers can still tell it apart from a successful calculation
+	ExitNoop = 66
+)
+
+// ExitCode - return process exit code for a given final state
+func ExitCode(state int) int {
+	switch state {
+	case StateCalculated:
+		return ExitOK
+	case StateNoop:
+		return ExitNoop
+	default:
+		return ExitError
+	}
+}
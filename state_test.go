@@ -0,0 +1,23 @@
+package calcmetric
+
+import "testing"
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		state    int
+		expected int
+	}{
+		{StateCalculated, ExitOK},
+		{StateNoop, ExitNoop},
+		{StateError, ExitError},
+		// anything unexpected is an error
+		{2, ExitError},
+		{-2, ExitError},
+	}
+	for _, test := range tests {
+		got := ExitCode(test.state)
+		if got != test.expected {
+			t.Errorf("state %d: expected exit code %d, got %d", test.state, test.expected, got)
+		}
+	}
+}
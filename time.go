@@ -7,6 +7,7 @@ import (
 
 // TimeParseAny - attempts to parse time from string YYYY-MM-DD HH:MI:SS
 // Skipping parts from right until only YYYY id left
+// Returns zero time on error, so callers ignoring the error won't silently get current time
 func TimeParseAny(dtStr string) (time.Time, error) {
 	formats := []string{
 		"2006-01-02T15:04:05Z",
@@ -25,7 +26,7 @@ func TimeParseAny(dtStr string) (time.Time, error) {
 	}
 	msg := fmt.Sprintf("error: cannot parse date: '%v'", dtStr)
 	Logf("%s\n", msg)
-	return time.Now(), fmt.Errorf(msg)
+	return time.Time{}, fmt.Errorf("%s", msg)
 }
 
 // DayStart - return time rounded to current day start
@@ -53,12 +54,18 @@ func PrevDayStart(dt time.Time) time.Time {
 }
 
 // WeekStart - return time rounded to current week start
-// Assumes first week day is Sunday
+// Assumes first week day is Monday
 func WeekStart(dt time.Time) time.Time {
+	return WeekStartOn(dt, time.Monday)
+}
+
+// WeekStartOn - return time rounded to current week start
+// Week starts on the firstDay week day
+func WeekStartOn(dt time.Time, firstDay time.Weekday) time.Time {
 	wDay := int(dt.Weekday())
 	// Go returns negative numbers for `modulo` operation when argument is negative
-	// So instead of wDay-1 I'm using wDay+6
-	subDays := (wDay + 6) % 7
+	// So instead of wDay-firstDay I'm using wDay+7-firstDay
+	subDays := (wDay + 7 - int(firstDay)) % 7
 	return DayStart(dt).AddDate(0, 0, -subDays)
 }
 
@@ -110,6 +117,38 @@ func ToYMDHMS(dt time.Time) string {
 	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", dt.Year(), dt.Month(), dt.Day(), dt.Hour(), dt.Minute(), dt.Second())
 }
 
+// ToYMDHMSf - return time formatted as YYYY-MM-DD HH:MI:SS.fff with prec (up to 9) fractional second digits
+// prec <= 0 gives the same output as ToYMDHMS
+func ToYMDHMSf(dt time.Time, prec int) string {
+	if prec <= 0 {
+		return ToYMDHMS(dt)
+	}
+	if prec > 9 {
+		prec = 9
+	}
+	return ToYMDHMS(dt) + "." + fmt.Sprintf("%09d", dt.Nanosecond())[:prec]
+}
+
+// TimeLayout - return golang time layout for a given time format
+// "ms", "us", "ns" mean YYYY-MM-DD HH:MI:SS with milli, micro or nano seconds, anything else is used as a golang layout
+func TimeLayout(format string) string {
+	switch format {
+	case "ms":
+		return "2006-01-02 15:04:05.000"
+	case "us":
+		return "2006-01-02 15:04:05.000000"
+	case "ns":
+		return "2006-01-02 15:04:05.000000000"
+	default:
+		return format
+	}
+}
+
+// ToYMD - return time formatted as YYYY-MM-DD (suitable for binding to date columns)
+func ToYMD(dt time.Time) string {
+	return fmt.Sprintf("%04d-%02d-%02d", dt.Year(), dt.Month(), dt.Day())
+}
+
 // ToYMDQuoted - return time formatted as 'YYYY-MM-DD'
 func ToYMDQuoted(dt time.Time) string {
 	return fmt.Sprintf("'%04d-%02d-%02d'", dt.Year(), dt.Month(), dt.Day())
@@ -0,0 +1,61 @@
+package calcmetric
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestTimeParseAnyRoundTrip(t *testing.T) {
+	LogOutput = ioutil.Discard
+	dt := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	tests := []struct {
+		format   string
+		expected time.Time
+	}{
+		{"2006-01-02T15:04:05Z", dt},
+		{"2006-01-02 15:04:05", dt},
+		{"2006-01-02 15:04", time.Date(2023, 4, 5, 6, 7, 0, 0, time.UTC)},
+		{"2006-01-02 15", time.Date(2023, 4, 5, 6, 0, 0, 0, time.UTC)},
+		{"2006-01-02", time.Date(2023, 4, 5, 0, 0, 0, 0, time.UTC)},
+		{"2006-01", time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"2006", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		str := dt.Format(test.format)
+		got, err := TimeParseAny(str)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %+v", str, err)
+			continue
+		}
+		if !got.Equal(test.expected) {
+			t.Errorf("%s: expected %v, got %v", str, test.expected, got)
+		}
+	}
+}
+
+func TestTimeParseAnyError(t *testing.T) {
+	LogOutput = ioutil.Discard
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", "error: cannot parse date: ''"},
+		{"2023-13-45", "error: cannot parse date: '2023-13-45'"},
+		{"yesterday", "error: cannot parse date: 'yesterday'"},
+		{"100%d %s %v", "error: cannot parse date: '100%d %s %v'"},
+	}
+	for _, test := range tests {
+		got, err := TimeParseAny(test.input)
+		if err == nil {
+			t.Errorf("%q: expected error, got %v", test.input, got)
+			continue
+		}
+		if !got.IsZero() {
+			t.Errorf("%q: expected zero time on error, got %v", test.input, got)
+		}
+		if err.Error() != test.expected {
+			t.Errorf("%q: expected error %q, got %q", test.input, test.expected, err.Error())
+		}
+	}
+}